@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidFwMark = errors.New("should be a number such as 0x100 or 256")
+)
+
+func checkBindAddr(value string) error {
+	_, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Addr: strings.TrimSpace(value)})
+	return err
+}
+
+func checkBindInterface(value string) error {
+	_, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Interface: strings.TrimSpace(value)})
+	return err
+}
+
+func checkFwMark(value string) error {
+	mark, err := parseFwMark(value)
+	if err != nil {
+		return err
+	}
+	_, err = tunnelclient.NewBindDialer(tunnelclient.BindOptions{Mark: mark})
+	return err
+}
+
+// parseFwMark 解析十进制或 0x 开头的十六进制
+func parseFwMark(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	mark, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, ErrInvalidFwMark
+	}
+	return int(mark), nil
+}
+
+// bindDialer 按 BindAddr, BindInterface 和 FwMark 连接上游, 都没有设置时为 nil
+func bindDialer(c *lineconfig.LineConfig, def listenerDef) tunnelclient.Dialer {
+	opt := tunnelclient.BindOptions{
+		Addr:      strings.TrimSpace(listenerValue(c, def, "BindAddr")),
+		Interface: strings.TrimSpace(listenerValue(c, def, "BindInterface")),
+	}
+	opt.Mark, _ = parseFwMark(listenerValue(c, def, "FwMark"))
+	if opt == (tunnelclient.BindOptions{}) {
+		return nil
+	}
+	d, err := tunnelclient.NewBindDialer(opt)
+	if err != nil {
+		log.Printf("listener %s: %s\n", def.name, err)
+		return nil
+	}
+	return d
+}
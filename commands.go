@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+var (
+	// Version 编译时通过 -ldflags "-X main.Version=v1.0.0" 设置
+	Version = "dev"
+)
+
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	applyFlags := configFlags(fs)
+	watchInterval := fs.Duration("w", 0, "reload config when the file changes, check interval, 0 to disable")
+	statsInterval := fs.Duration("stats", 0, "log connection and traffic stats, interval, 0 to disable")
+	m := fs.String("m", "http", "serve mode of the default listener, http, socks5, redirect or mixed, overrides Mode")
+	printCfg := fs.Bool("print-config", false, "print the merged config with secrets masked, then exit")
+	fs.Parse(args)
+
+	err := applyFlags()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "m" {
+			overrides.add("Mode", *m)
+		}
+	})
+
+	lc, err = loadConfig(configPath)
+	if err != nil {
+		log.Printf("load config error: %s\n", err)
+		return 1
+	}
+	log.Printf("config loaded from %s\n", configPath)
+
+	if *printCfg {
+		err = printConfig(os.Stdout, lc)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	srv := newServer(lc)
+	for _, tc := range srv.Listeners() {
+		log.Printf("listener %s: %s on %s\n", tc.Name, tc.Mode, tc.LocalAddr)
+	}
+
+	go reloadOnSignal(srv)
+	if *watchInterval > 0 {
+		go reloadOnChange(srv, *watchInterval)
+	}
+	if *statsInterval > 0 {
+		go func() {
+			for range time.Tick(*statsInterval) {
+				log.Printf("stats: %s\n", srv.Metrics.Snapshot())
+			}
+		}()
+	}
+	log.Println(srv.ListenAndServe())
+	return 1
+}
+
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	applyFlags := configFlags(fs)
+	fs.Parse(args)
+
+	err := applyFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	_, err = loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", configPath)
+	return 0
+}
+
+// runProbe 探测默认上游和所有 [upstream.name]
+func runProbe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	applyFlags := configFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s probe [flags] [host:port]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	target := "www.baidu.com:80"
+	if fs.NArg() > 0 {
+		target = fs.Arg(0)
+	}
+
+	err := applyFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	lc, err = loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	code := 0
+	for _, name := range upstreamNames(lc) {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		applyUpstream(tc, lc, upstreamConfig(lc, name))
+		tc.SetDialer(bindDialer(lc, listenerDef{name: defaultName, sec: lc}))
+		if name == "" {
+			name = defaultName
+		}
+
+		res, err := tc.Probe(target)
+		fmt.Printf("%s (%s) -> %s: dial %s, connect %s",
+			name, res.Upstream, res.Target, res.DialTime.Round(time.Millisecond), res.ConnectTime.Round(time.Millisecond))
+		if err != nil {
+			fmt.Printf(", error: %s\n", err)
+			code = 1
+			continue
+		}
+		fmt.Printf(", %s\n", res.StatusLine)
+	}
+	return code
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("tcp_over_http_proxy %s %s %s/%s\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return 0
+	}
+	fmt.Printf("module %s %s\n", info.Main.Path, info.Main.Version)
+	for _, dep := range info.Deps {
+		fmt.Printf("  %s %s\n", dep.Path, dep.Version)
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"github.com/iikira/tcp_over_http_proxy/configloader"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// override 命令行中覆盖配置文件的值
+	override struct {
+		key   string
+		value string
+	}
+
+	// overrideFlag 可重复的 -set Key=Value
+	overrideFlag []override
+)
+
+const (
+	secretMask = "******"
+)
+
+var (
+	// 顶层的 LocalAddr 等为默认监听, DestAddr 和 Headers 为默认上游
+	configSchema = lineconfig.Schema{
+		{Key: "LocalAddr", Type: lineconfig.TypeString, Check: tunnelclient.CheckListenAddr},
+		{Key: "SocketMode", Type: lineconfig.TypeString, Check: checkSocketMode},
+		{Key: "SocketOwner", Type: lineconfig.TypeString},
+		{Key: "Mode", Type: lineconfig.TypeString, Check: checkMode},
+		{Key: "Auth", Type: lineconfig.TypeList, Multiple: true, Secret: true, Check: checkAuth},
+		{Key: "DestAddr", Type: lineconfig.TypeHostPort},
+		{Key: "Headers", Type: lineconfig.TypeString},
+		{Key: "Chain", Type: lineconfig.TypeList},
+		{Key: "RelayMethod", Type: lineconfig.TypeList},
+		{Key: "RelayUpstream", Type: lineconfig.TypeString},
+		{Key: "RelayHeaders", Type: lineconfig.TypeString},
+		{Key: "RelayAbsoluteURI", Type: lineconfig.TypeBool},
+		{Key: "GlobalRateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "RateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "UserRateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "IPRateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "MaxConns", Type: lineconfig.TypeInt, Check: checkConnLimit},
+		{Key: "MaxConnsPerIP", Type: lineconfig.TypeInt, Check: checkConnLimit},
+		{Key: "AllowClient", Type: lineconfig.TypeList, Multiple: true, Check: checkIPList},
+		{Key: "DenyClient", Type: lineconfig.TypeList, Multiple: true, Check: checkIPList},
+		{Key: "AllowPort", Type: lineconfig.TypeList, Check: checkPortList},
+		{Key: "BlockPrivate", Type: lineconfig.TypeBool},
+		{Key: "DenyDest", Type: lineconfig.TypeList, Multiple: true, Check: checkDestList},
+		{Key: "ErrorPage", Type: lineconfig.TypeString, Check: checkErrorPage},
+		{Key: "ConnectReply", Type: lineconfig.TypeString, Check: checkConnectReply},
+		{Key: "BindAddr", Type: lineconfig.TypeString, Check: checkBindAddr},
+		{Key: "BindInterface", Type: lineconfig.TypeString, Check: checkBindInterface},
+		{Key: "FwMark", Type: lineconfig.TypeString, Check: checkFwMark},
+		{Key: listenerSection, Type: lineconfig.TypeSection, Section: listenerSchema},
+		{Key: upstreamSection, Type: lineconfig.TypeSection, Section: upstreamSchema},
+	}
+
+	listenerSchema = lineconfig.Schema{
+		{Key: "LocalAddr", Type: lineconfig.TypeString, Required: true, Check: tunnelclient.CheckListenAddr},
+		{Key: "SocketMode", Type: lineconfig.TypeString, Check: checkSocketMode},
+		{Key: "SocketOwner", Type: lineconfig.TypeString},
+		{Key: "Mode", Type: lineconfig.TypeString, Check: checkMode},
+		{Key: "Auth", Type: lineconfig.TypeList, Multiple: true, Secret: true, Check: checkAuth},
+		{Key: "Upstream", Type: lineconfig.TypeString},
+		{Key: "RelayMethod", Type: lineconfig.TypeList},
+		{Key: "RelayUpstream", Type: lineconfig.TypeString},
+		{Key: "RelayHeaders", Type: lineconfig.TypeString},
+		{Key: "RelayAbsoluteURI", Type: lineconfig.TypeBool},
+		{Key: "RateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "UserRateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "IPRateLimit", Type: lineconfig.TypeString, Check: checkRate},
+		{Key: "MaxConns", Type: lineconfig.TypeInt, Check: checkConnLimit},
+		{Key: "MaxConnsPerIP", Type: lineconfig.TypeInt, Check: checkConnLimit},
+		{Key: "AllowClient", Type: lineconfig.TypeList, Multiple: true, Check: checkIPList},
+		{Key: "DenyClient", Type: lineconfig.TypeList, Multiple: true, Check: checkIPList},
+		{Key: "AllowPort", Type: lineconfig.TypeList, Check: checkPortList},
+		{Key: "BlockPrivate", Type: lineconfig.TypeBool},
+		{Key: "DenyDest", Type: lineconfig.TypeList, Multiple: true, Check: checkDestList},
+		{Key: "ErrorPage", Type: lineconfig.TypeString, Check: checkErrorPage},
+		{Key: "ConnectReply", Type: lineconfig.TypeString, Check: checkConnectReply},
+		{Key: "BindAddr", Type: lineconfig.TypeString, Check: checkBindAddr},
+		{Key: "BindInterface", Type: lineconfig.TypeString, Check: checkBindInterface},
+		{Key: "FwMark", Type: lineconfig.TypeString, Check: checkFwMark},
+	}
+
+	// 有 Chain 时依次通过其中的上游连接, 不需要 DestAddr
+	upstreamSchema = lineconfig.Schema{
+		{Key: "Type", Type: lineconfig.TypeString, Check: checkHopType},
+		{Key: "DestAddr", Type: lineconfig.TypeHostPort},
+		{Key: "Headers", Type: lineconfig.TypeString},
+		{Key: "Auth", Type: lineconfig.TypeString, Secret: true, Check: checkAuth},
+		{Key: "TLSServerName", Type: lineconfig.TypeString},
+		{Key: "TLSInsecure", Type: lineconfig.TypeBool},
+		{Key: "TLSCA", Type: lineconfig.TypeString, Check: checkCertPool},
+		{Key: "Chain", Type: lineconfig.TypeList},
+	}
+
+	overrides overrideFlag
+)
+
+func (of *overrideFlag) String() string {
+	s := make([]string, len(*of))
+	for k, o := range *of {
+		s[k] = o.key + "=" + o.value
+	}
+	return strings.Join(s, " ")
+}
+
+func (of *overrideFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return lineconfig.ErrSyntax
+	}
+	return of.add(s[:i], s[i+1:])
+}
+
+// add 值与配置文件相同, 支持 \r\n 等转义
+func (of *overrideFlag) add(key, value string) error {
+	value, err := strconv.Unquote("\"" + value + "\"")
+	if err != nil {
+		return err
+	}
+	*of = append(*of, override{
+		key:   strings.TrimSpace(key),
+		value: value,
+	})
+	return nil
+}
+
+// apply 写入配置, 分组内的 key 写作 listener.web.LocalAddr
+func (of overrideFlag) apply(c *lineconfig.LineConfig) {
+	for _, o := range of {
+		i := strings.LastIndexByte(o.key, '.')
+		if i < 0 {
+			c.Set(o.key, o.value)
+			continue
+		}
+		c.AddSection(o.key[:i]).Set(o.key[i+1:], o.value)
+	}
+}
+
+// loadConfig 读取配置文件, 应用命令行的覆盖后校验, 格式由扩展名决定
+func loadConfig(fPath string) (*lineconfig.LineConfig, error) {
+	c, err := configloader.Load(fPath)
+	if err != nil {
+		return nil, err
+	}
+	overrides.apply(c)
+
+	err = c.Validate(configSchema)
+	if err != nil {
+		return nil, err
+	}
+	err = validateListeners(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// printConfig 输出合并后的配置, 隐藏敏感信息
+func printConfig(w io.Writer, c *lineconfig.LineConfig) error {
+	masked := c.Clone()
+	masked.Map(maskSecret)
+	_, err := masked.WriteTo(w)
+	return err
+}
+
+func maskSecret(key, value string) string {
+	if f := configSchema.Lookup(key); f != nil && f.Secret {
+		return secretMask
+	}
+	// 节内的键为 section.name.Key
+	switch key[strings.LastIndexByte(key, '.')+1:] {
+	case "Headers", "RelayHeaders":
+		return maskAuthHeaders(value)
+	}
+	return value
+}
+
+// maskAuthHeaders 隐藏 Authorization 和 Proxy-Authorization 的值
+func maskAuthHeaders(headers string) string {
+	lines := strings.Split(headers, "\r\n")
+	for k, line := range lines {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:i])
+		if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Proxy-Authorization") {
+			lines[k] = line[:i+1] + " " + secretMask
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,157 @@
+// Package configloader 按扩展名选择配置格式, 统一读取为 lineconfig.LineConfig.
+//
+// 默认使用 lineconfig 的 key=value; 格式, .json, .yaml, .yml, .toml 使用对应的格式.
+// 对象映射为分组: 顶层的 upstream: {carrier: {...}} 对应 [upstream.carrier];
+// 对象数组同样映射为分组, 有 Name 字段时以其作为分组名的后缀, 否则使用下标;
+// 标量数组映射为同一个 key 的多个值.
+package configloader
+
+import (
+	"errors"
+	"fmt"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Format 配置文件格式
+	Format string
+
+	decodeFunc func(data []byte) (map[string]interface{}, error)
+)
+
+const (
+	FormatLine Format = "line"
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+
+	// NameKey 对象数组中作为分组名的字段
+	NameKey = "Name"
+)
+
+var (
+	ErrNestedList = errors.New("nested list is not supported")
+
+	decoders = map[Format]decodeFunc{
+		FormatJSON: decodeJSON,
+		FormatYAML: decodeYAML,
+		FormatTOML: decodeTOML,
+	}
+)
+
+// FormatOf 根据扩展名判断格式
+func FormatOf(fPath string) Format {
+	switch strings.ToLower(filepath.Ext(fPath)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatLine
+}
+
+// Load 读取配置文件
+func Load(fPath string) (*lineconfig.LineConfig, error) {
+	lc := lineconfig.NewLineConfig()
+	format := FormatOf(fPath)
+	if format == FormatLine {
+		return lc, lc.LoadFrom(fPath)
+	}
+
+	data, err := ioutil.ReadFile(fPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := decoders[format](data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fPath, err)
+	}
+
+	err = fill(lc, lc, "", m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fPath, err)
+	}
+	return lc, nil
+}
+
+// fill 将 m 写入分组 name, 分组在写入第一个值时才创建
+func fill(root, sec *lineconfig.LineConfig, name string, m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // map 无序, 保证结果稳定
+
+	for _, key := range keys {
+		err := fillValue(root, &sec, name, key, m[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fillValue(root *lineconfig.LineConfig, sec **lineconfig.LineConfig, name, key string, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return fill(root, nil, join(name, key), v)
+	case []interface{}:
+		for k, item := range v {
+			switch item := item.(type) {
+			case map[string]interface{}:
+				suffix := strconv.Itoa(k)
+				if n, ok := item[NameKey].(string); ok && n != "" {
+					suffix = n
+					delete(item, NameKey)
+				}
+				err := fill(root, nil, join(join(name, key), suffix), item)
+				if err != nil {
+					return err
+				}
+			case []interface{}:
+				return fmt.Errorf("%s: %s", join(name, key), ErrNestedList)
+			default:
+				add(root, sec, name, key, item)
+			}
+		}
+		return nil
+	}
+	add(root, sec, name, key, v)
+	return nil
+}
+
+func add(root *lineconfig.LineConfig, sec **lineconfig.LineConfig, name, key string, v interface{}) {
+	if *sec == nil {
+		*sec = root.AddSection(name)
+	}
+	(*sec).Add(key, scalarString(v))
+}
+
+func join(name, key string) string {
+	if name == "" {
+		return key
+	}
+	return name + "." + key
+}
+
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
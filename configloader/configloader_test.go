@@ -0,0 +1,92 @@
+package configloader_test
+
+import (
+	"github.com/iikira/tcp_over_http_proxy/configloader"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"c.json": `{
+	"LocalAddr": "0.0.0.0:1252",
+	"RelayMethod": ["GET", "POST"],
+	"MaxConns": 100,
+	"SocketMode": "0660",
+	"upstream": {"carrier": {"DestAddr": "10.0.0.172:80"}},
+	"listener": [{"Name": "web", "Mode": "http"}, {"Mode": "socks5"}]
+}`,
+		"c.yaml": `LocalAddr: 0.0.0.0:1252
+RelayMethod: [GET, POST]
+MaxConns: 100
+SocketMode: 0660
+upstream:
+  carrier:
+    DestAddr: 10.0.0.172:80
+listener:
+  - Name: web
+    Mode: http
+  - Mode: socks5
+`,
+		"c.toml": `LocalAddr = "0.0.0.0:1252"
+RelayMethod = ["GET", "POST"]
+MaxConns = 100
+SocketMode = "0660"
+
+[upstream.carrier]
+DestAddr = "10.0.0.172:80"
+
+[[listener]]
+Name = "web"
+Mode = "http"
+
+[[listener]]
+Mode = "socks5"
+`,
+	}
+
+	for name, content := range files {
+		fPath := filepath.Join(dir, name)
+		err = ioutil.WriteFile(fPath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lc, err := configloader.Load(fPath)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if addr := lc.String("LocalAddr", ""); addr != "0.0.0.0:1252" {
+			t.Errorf("%s: LocalAddr: got %q", name, addr)
+		}
+		if list := lc.List("RelayMethod", nil); strings.Join(list, ",") != "GET,POST" {
+			t.Errorf("%s: RelayMethod: got %q", name, list)
+		}
+		if n := lc.Int("MaxConns", 0); n != 100 {
+			t.Errorf("%s: MaxConns: got %d", name, n)
+		}
+		// yaml 中不加引号的 0660 为八进制整数, 应保留原文
+		if mode := lc.String("SocketMode", ""); mode != "0660" {
+			t.Errorf("%s: SocketMode: got %q", name, mode)
+		}
+		if addr := lc.Section("upstream.carrier").String("DestAddr", ""); addr != "10.0.0.172:80" {
+			t.Errorf("%s: upstream.carrier: got %q", name, addr)
+		}
+		if sections := strings.Join(lc.Sections(), " "); sections != "listener.web listener.1 upstream.carrier" {
+			t.Errorf("%s: sections: got %q", name, sections)
+		}
+		if mode := lc.Section("listener.1").String("Mode", ""); mode != "socks5" {
+			t.Errorf("%s: listener.1: got %q", name, mode)
+		}
+	}
+}
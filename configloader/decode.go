@@ -0,0 +1,101 @@
+package configloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+func decodeJSON(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber() // 保留整数的原样
+	err := d.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func decodeYAML(data []byte) (map[string]interface{}, error) {
+	var v yamlValue
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	res, _ := v.v.(map[string]interface{})
+	return res, nil
+}
+
+// yamlValue yaml 的值, 对象转换为 map[string]interface{}.
+// 整数保留原文: yaml 1.1 中 0660 为八进制, 解析为 432 后无法还原为配置中的写法.
+type yamlValue struct {
+	v interface{}
+}
+
+func (y *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal(&y.v)
+	if err != nil {
+		return err
+	}
+	switch y.v.(type) {
+	case map[interface{}]interface{}:
+		var m map[string]yamlValue
+		err = unmarshal(&m)
+		if err != nil {
+			return err
+		}
+		res := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			res[key] = value.v
+		}
+		y.v = res
+	case []interface{}:
+		var l []yamlValue
+		err = unmarshal(&l)
+		if err != nil {
+			return err
+		}
+		res := make([]interface{}, len(l))
+		for k := range l {
+			res[k] = l[k].v
+		}
+		y.v = res
+	case int, int64, uint64:
+		var s string
+		err = unmarshal(&s)
+		if err != nil {
+			return err
+		}
+		y.v = s
+	}
+	return nil
+}
+
+func decodeTOML(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	_, err := toml.Decode(string(data), &m)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeTOML(m), nil
+}
+
+// normalizeTOML 表数组解析为 []map[string]interface{}, 转换为 []interface{}
+func normalizeTOML(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	for key, value := range m {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			normalizeTOML(value)
+		case []map[string]interface{}:
+			list := make([]interface{}, len(value))
+			for k := range value {
+				list[k] = normalizeTOML(value[k])
+			}
+			m[key] = list
+		}
+	}
+	return m
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"html/template"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+func checkErrorPage(value string) error {
+	_, err := loadErrorPage(value)
+	return err
+}
+
+// loadErrorPage 读取 HTML 错误页面模板
+func loadErrorPage(fPath string) (*template.Template, error) {
+	fPath = strings.TrimSpace(fPath)
+	return template.New(filepath.Base(fPath)).ParseFiles(fPath)
+}
+
+// errorPage 监听的错误页面模板, 没有设置时为 nil
+func errorPage(c *lineconfig.LineConfig, def listenerDef) *template.Template {
+	fPath := listenerValue(c, def, "ErrorPage")
+	if strings.TrimSpace(fPath) == "" {
+		return nil
+	}
+	tmpl, err := loadErrorPage(fPath)
+	if err != nil {
+		log.Printf("listener %s: load ErrorPage error: %s\n", def.name, err)
+		return nil
+	}
+	return tmpl
+}
@@ -3,7 +3,9 @@ module github.com/iikira/tcp_over_http_proxy
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.0
 	github.com/ginuerzh/gosocks5 v0.2.0
 	github.com/iikira/BaiduPCS-Go v0.0.0-20190810052828-437c7b2651e5
 	golang.org/x/net v0.0.0-20200320220750-118fecf932d8
+	gopkg.in/yaml.v2 v2.4.0
 )
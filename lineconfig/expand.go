@@ -0,0 +1,72 @@
+package lineconfig
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ErrUnterminatedVar = errors.New("unterminated ${")
+	ErrInvalidVarName  = errors.New("invalid variable name")
+)
+
+// expandEnv 替换 ${ENV} 和 ${ENV:-default}, 后者在变量未设置或为空时使用默认值.
+// $${ 表示字面的 ${.
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' { // $${
+			b.WriteString(s[:i])
+			b.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", ErrUnterminatedVar
+		}
+		expr := s[i+2 : i+end]
+		s = s[i+end+1:]
+
+		name, def, hasDef := expr, "", false
+		if j := strings.Index(expr, ":-"); j >= 0 {
+			name, def, hasDef = expr[:j], expr[j+2:], true
+		}
+		if !isValidVarName(name) {
+			return "", ErrInvalidVarName
+		}
+
+		value := os.Getenv(name)
+		if value == "" && hasDef {
+			value = def
+		}
+		b.WriteString(value)
+	}
+}
+
+func isValidVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for k, r := range name {
+		switch {
+		case r == '_', 'A' <= r && r <= 'Z', 'a' <= r && r <= 'z':
+		case '0' <= r && r <= '9' && k > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package lineconfig
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// String 获取字符串, key 不存在时返回 def
+func (lc *LineConfig) String(key, def string) string {
+	value, ok := lc.Get(key)
+	if !ok {
+		return def
+	}
+	return value
+}
+
+// Int 获取整数, key 不存在或格式错误时返回 def
+func (lc *LineConfig) Int(key string, def int) int {
+	i, err := strconv.Atoi(strings.TrimSpace(lc.String(key, "")))
+	if err != nil {
+		return def
+	}
+	return i
+}
+
+// Bool 获取布尔值, key 不存在或格式错误时返回 def
+func (lc *LineConfig) Bool(key string, def bool) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(lc.String(key, "")))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// Duration 获取时长, 如 "10s", key 不存在或格式错误时返回 def
+func (lc *LineConfig) Duration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(lc.String(key, "")))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// List 获取以逗号分隔的列表, 忽略空项, key 不存在时返回 def.
+// key 出现多次时, 按顺序合并所有值.
+func (lc *LineConfig) List(key string, def []string) []string {
+	values := lc.Values(key)
+	if len(values) == 0 {
+		return def
+	}
+	var list []string
+	for _, value := range values {
+		list = append(list, splitList(value)...)
+	}
+	return list
+}
+
+// HostPort 获取 host:port 形式的地址, key 不存在或格式错误时返回 def
+func (lc *LineConfig) HostPort(key, def string) string {
+	value := strings.TrimSpace(lc.String(key, ""))
+	if checkHostPort(value) != nil {
+		return def
+	}
+	return value
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+func checkHostPort(value string) error {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return ErrInvalidPort
+	}
+	return nil
+}
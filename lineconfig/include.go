@@ -0,0 +1,92 @@
+package lineconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	includeKeyword = "include"
+)
+
+// isInclude 是否为 include "path"; 语句, include="..." 仍视为普通的 key
+func (p *parser) isInclude() bool {
+	end := p.pos + len(includeKeyword)
+	if end > len(p.src) || string(p.src[p.pos:end]) != includeKeyword {
+		return false
+	}
+	for ; end < len(p.src); end++ {
+		switch p.src[end] {
+		case ' ', '\t':
+			continue
+		case '=':
+			return false
+		}
+		break
+	}
+	return end > p.pos+len(includeKeyword)
+}
+
+// parseInclude 解析 include "path"; 被引入文件的内容归入当前分组
+func (p *parser) parseInclude() {
+	line, col := p.line, p.col
+	for range includeKeyword {
+		p.next()
+	}
+	p.skipBlank()
+
+	raw, ok := p.scanValue(includeKeyword)
+	if !ok {
+		return
+	}
+	path, err := strconv.Unquote("\"" + raw + "\"")
+	if err == nil {
+		path, err = expandEnv(path)
+	}
+	if err != nil {
+		p.errorf(line, col, includeKeyword, err, "invalid path")
+		return
+	}
+	if path == "" {
+		p.errorf(line, col, includeKeyword, ErrSyntax, "missing path")
+		return
+	}
+
+	if !filepath.IsAbs(path) && p.file != "" {
+		path = filepath.Join(filepath.Dir(p.file), path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		p.errorf(line, col, includeKeyword, err, "invalid path")
+		return
+	}
+	for k, f := range p.stack {
+		if f == abs {
+			cycle := append(p.stack[k:len(p.stack):len(p.stack)], abs)
+			p.errorf(line, col, includeKeyword, nil, "include cycle: %s", strings.Join(cycle, " -> "))
+			return
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		p.errorf(line, col, includeKeyword, err, "include failed")
+		return
+	}
+	defer file.Close()
+
+	child, err := newParser(file, path)
+	if err != nil {
+		p.errorf(line, col, includeKeyword, err, "include failed")
+		return
+	}
+	p.root.files = append(p.root.files, abs)
+	child.root = p.root
+	child.cur = p.cur
+	child.included = true
+	child.stack = append(p.stack[:len(p.stack):len(p.stack)], abs)
+	child.parse()
+	p.errs = append(p.errs, child.errs...)
+}
@@ -1,83 +1,283 @@
 package lineconfig
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
-	"github.com/iikira/BaiduPCS-Go/pcsliner/args"
-	"github.com/iikira/BaiduPCS-Go/pcsutil/converter"
 	"io"
 	"os"
-	"strconv"
-	"strings"
+	"path/filepath"
 )
 
 type (
-	LineConfig map[string]string
+	// LineConfig 以 key=value; 逐行书写的配置.
+	// 旧版本为 map[string]string, 现在通过 Get, String, Values 等方法读取.
+	// 同一个 key 可以出现多次, 按出现顺序保存;
+	// [name] 开始一个分组, 直到下一个分组或文件结束;
+	// include "path"; 引入其他配置文件, 相对路径以当前文件所在目录为准;
+	// 值中的 ${ENV} 和 ${ENV:-default} 替换为环境变量.
+	LineConfig struct {
+		name     string
+		pos      position // 分组首次出现的位置
+		entries  []*entry
+		sections []*LineConfig
+		files    []string // 读取过的文件, 包括 include 的文件
+		doc      []*node  // 最外层文件的原文, 用于 WriteTo
+	}
+
+	entry struct {
+		key   string
+		value string
+		pos   position
+
+		inDoc    bool // 在原文中有对应的 node
+		included bool // 来自 include 的文件
+		dirty    bool // 值已被修改
+		deleted  bool
+	}
+
+	// node 原文的片段: 一条配置, 一个分组名, 或者注释和空白等其他内容
+	node struct {
+		text    string
+		entry   *entry
+		section *LineConfig
+	}
+
+	position struct {
+		file   string
+		line   int
+		column int
+	}
 )
 
 var (
 	ErrSyntax = errors.New("syntax error")
 )
 
-func NewLineConfig() LineConfig {
-	return LineConfig{}
+func NewLineConfig() *LineConfig {
+	return &LineConfig{}
 }
 
-func (lc LineConfig) lazyInit() {
-	if lc == nil {
-		lc = LineConfig{}
-	}
-}
-
-func (lc LineConfig) LoadFrom(fPath string) (err error) {
+func (lc *LineConfig) LoadFrom(fPath string) (err error) {
 	file, err := os.Open(fPath)
 	if err != nil {
 		return
 	}
 	defer file.Close()
 
-	err = lc.ParseFromReader(file)
-	if err != nil {
-		return
-	}
-	return
+	return lc.parse(file, fPath)
+}
+
+// ParseFromReader 解析配置, 出错时返回 ErrorList, 包含全部错误的位置
+func (lc *LineConfig) ParseFromReader(reader io.Reader) (err error) {
+	return lc.parse(reader, "")
 }
 
-func (lc LineConfig) ParseFromReader(reader io.Reader) (err error) {
-	r := bufio.NewReader(reader)
-	for {
-		line, err := r.ReadBytes(';')
+func (lc *LineConfig) parse(reader io.Reader, file string) error {
+	p, err := newParser(reader, file)
+	if err != nil {
+		return err
+	}
+	p.root = lc
+	p.cur = lc
+	p.record = lc.doc == nil
+	if file != "" {
+		abs, err := filepath.Abs(file)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-		line = bytes.TrimSpace(line)
-		line = bytes.TrimSuffix(line, []byte{';'})
-		if len(line) == 0 {
+		p.stack = []string{abs}
+		lc.files = append(lc.files, abs)
+	}
+	p.parse()
+	return p.errs.Err()
+}
+
+// Files 返回读取过的所有配置文件, 包括 include 的文件
+func (lc *LineConfig) Files() []string {
+	if lc == nil {
+		return nil
+	}
+	return lc.files
+}
+
+// Name 分组名, 顶层为空
+func (lc *LineConfig) Name() string {
+	if lc == nil {
+		return ""
+	}
+	return lc.name
+}
+
+// Keys 按首次出现的顺序返回所有 key, 不含分组内的 key
+func (lc *LineConfig) Keys() []string {
+	if lc == nil {
+		return nil
+	}
+	var (
+		keys []string
+		seen = map[string]bool{}
+	)
+	for _, e := range lc.entries {
+		if seen[e.key] {
 			continue
 		}
+		seen[e.key] = true
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// Values 按出现顺序返回 key 的所有值
+func (lc *LineConfig) Values(key string) []string {
+	if lc == nil {
+		return nil
+	}
+	var values []string
+	for _, e := range lc.entries {
+		if e.key == key {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
 
-		if line[0] == '#' { // 注释
+// Get 返回 key 最后一次出现的值, 与只保留最后一个值的旧行为一致
+func (lc *LineConfig) Get(key string) (value string, ok bool) {
+	e := lc.last(key)
+	if e == nil {
+		return "", false
+	}
+	return e.value, true
+}
+
+// Set 设置 key 的值, 替换已有的所有值
+func (lc *LineConfig) Set(key, value string) {
+	var (
+		kept  = lc.entries[:0]
+		found bool
+	)
+	for _, e := range lc.entries {
+		if e.key != key {
+			kept = append(kept, e)
+			continue
+		}
+		if !found {
+			found = true
+			e.value = value
+			e.dirty = true
+			if e.included { // 不修改 include 的文件, 写入当前文件
+				e.included, e.inDoc = false, false
+			}
+			kept = append(kept, e)
 			continue
 		}
+		e.deleted = true
+	}
+	lc.entries = kept
+	if !found {
+		lc.Add(key, value)
+	}
+}
 
-		splits := bytes.SplitN(line, []byte{'='}, 2)
-		if len(splits) != 2 {
-			return ErrSyntax
+// Add 为 key 追加一个值
+func (lc *LineConfig) Add(key, value string) {
+	lc.entries = append(lc.entries, &entry{
+		key:   key,
+		value: value,
+	})
+}
+
+// Delete 删除 key 的所有值
+func (lc *LineConfig) Delete(key string) {
+	kept := lc.entries[:0]
+	for _, e := range lc.entries {
+		if e.key != key {
+			kept = append(kept, e)
+			continue
 		}
+		e.deleted = true
+	}
+	lc.entries = kept
+}
 
-		splits[1] = bytes.TrimFunc(splits[1], args.IsQuote)
-		unquote, err := strconv.Unquote("\"" + converter.ToString(splits[1]) + "\"")
-		if err != nil {
-			return err
+// Clone 复制配置, 包括 include 的内容, 不保留原文
+func (lc *LineConfig) Clone() *LineConfig {
+	c := &LineConfig{
+		name: lc.name,
+		pos:  lc.pos,
+	}
+	for _, e := range lc.entries {
+		c.entries = append(c.entries, &entry{
+			key:   e.key,
+			value: e.value,
+			pos:   e.pos,
+		})
+	}
+	for _, sec := range lc.sections {
+		c.sections = append(c.sections, sec.Clone())
+	}
+	return c
+}
+
+// Map 用 fn 的返回值替换所有值, 包括分组内的值, 分组内的 key 写作 listener.web.LocalAddr
+func (lc *LineConfig) Map(fn func(key, value string) string) {
+	for _, e := range lc.entries {
+		value := fn(lc.qualify(e.key), e.value)
+		if value != e.value {
+			e.value = value
+			e.dirty = true
 		}
+	}
+	for _, sec := range lc.sections {
+		sec.Map(fn)
+	}
+}
+
+// Section 返回名为 name 的分组, 不存在时返回 nil.
+// nil 分组可以安全地调用各种 getter, 均返回默认值.
+func (lc *LineConfig) Section(name string) *LineConfig {
+	if lc == nil {
+		return nil
+	}
+	for _, s := range lc.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Sections 按首次出现的顺序返回所有分组名
+func (lc *LineConfig) Sections() []string {
+	if lc == nil {
+		return nil
+	}
+	names := make([]string, len(lc.sections))
+	for k, s := range lc.sections {
+		names[k] = s.name
+	}
+	return names
+}
 
-		unquote = strings.TrimFunc(unquote, args.IsQuote)
-		lc[converter.ToString(splits[0])] = unquote
+// AddSection 返回名为 name 的分组, 不存在时创建
+func (lc *LineConfig) AddSection(name string) *LineConfig {
+	s := lc.Section(name)
+	if s == nil {
+		s = &LineConfig{
+			name: name,
+		}
+		lc.sections = append(lc.sections, s)
 	}
+	return s
+}
 
+func (lc *LineConfig) last(key string) *entry {
+	if lc == nil {
+		return nil
+	}
+	for k := len(lc.entries) - 1; k >= 0; k-- {
+		if lc.entries[k].key == key {
+			return lc.entries[k]
+		}
+	}
 	return nil
 }
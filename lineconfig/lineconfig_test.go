@@ -0,0 +1,363 @@
+package lineconfig_test
+
+import (
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFromReader(t *testing.T) {
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(`# listen;
+LocalAddr="0.0.0.0:1252";
+DestAddr = '112.2.247.193:8080' ;
+Headers="Proxy-Connection: keep-alive\r\nX-Semi: a;b\r\n"; # trailing comment;
+RelayMethod=GET, POST;
+Last="no semicolon"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"LocalAddr":   "0.0.0.0:1252",
+		"DestAddr":    "112.2.247.193:8080",
+		"Headers":     "Proxy-Connection: keep-alive\r\nX-Semi: a;b\r\n",
+		"RelayMethod": "GET, POST",
+		"Last":        "no semicolon",
+	}
+	if keys := lc.Keys(); len(keys) != len(expected) {
+		t.Fatalf("got %d keys, expected %d: %v", len(keys), len(expected), keys)
+	}
+	for k, v := range expected {
+		if value := lc.String(k, ""); value != v {
+			t.Errorf("%s: got %q, expected %q", k, value, v)
+		}
+	}
+}
+
+// TestParseBaseline 旧版本的配置按旧版本的规则解析: 注释到下一个分号, key 为 = 之前的任意内容
+func TestParseBaseline(t *testing.T) {
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(`# listen
+LocalAddr="0.0.0.0:1252";
+#DestAddr="10.0.0.172:80";DestAddr="112.2.247.193:8080";
+# remote HTTP proxy custom header;
+Headers="Proxy-Connecton:keep-alive\r\n";
+X.Custom/Key="v";
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"DestAddr":     "112.2.247.193:8080",
+		"Headers":      "Proxy-Connecton:keep-alive\r\n",
+		"X.Custom/Key": "v",
+	}
+	if keys := lc.Keys(); len(keys) != len(expected) {
+		t.Fatalf("got %d keys, expected %d: %v", len(keys), len(expected), keys)
+	}
+	for k, v := range expected {
+		if value := lc.String(k, ""); value != v {
+			t.Errorf("%s: got %q, expected %q", k, value, v)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(`A="ok";
+B="unterminated;
+C="bad \q escape";
+no equal sign;
+D="x" junk;
+E="still parsed";
+`))
+	el, ok := err.(lineconfig.ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList, got %T: %v", err, err)
+	}
+
+	expected := []struct {
+		line, col int
+		key       string
+	}{
+		{2, 3, "B"},
+		{3, 3, "C"},
+		{4, 1, "no equal sign"},
+		{5, 7, "D"},
+	}
+	if len(el) != len(expected) {
+		t.Fatalf("got %d errors, expected %d:\n%s", len(el), len(expected), el)
+	}
+	for k, e := range expected {
+		if el[k].Line != e.line || el[k].Column != e.col || el[k].Key != e.key {
+			t.Errorf("error %d: got %d:%d %q, expected %d:%d %q", k, el[k].Line, el[k].Column, el[k].Key, e.line, e.col, e.key)
+		}
+	}
+
+	if lc.String("A", "") != "ok" || lc.String("E", "") != "still parsed" {
+		t.Errorf("valid entries not parsed: %v", lc.Keys())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	schema := lineconfig.Schema{
+		{Key: "LocalAddr", Type: lineconfig.TypeHostPort, Required: true},
+		{Key: "DestAddr", Type: lineconfig.TypeHostPort, Required: true},
+		{Key: "Timeout", Type: lineconfig.TypeDuration},
+		{Key: "Verbose", Type: lineconfig.TypeBool},
+	}
+
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(`LocalAddr="0.0.0.0:1252";
+Timeout="10 seconds";
+destaddr="1.2.3.4:80";
+Verbose=yes;`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	el, ok := lc.Validate(schema).(lineconfig.ErrorList)
+	if !ok {
+		t.Fatalf("expected ErrorList")
+	}
+	keys := make([]string, len(el))
+	for k := range el {
+		keys[k] = el[k].Key
+	}
+	if strings.Join(keys, ",") != "DestAddr,Timeout,destaddr,Verbose" {
+		t.Errorf("unexpected errors:\n%s", el)
+	}
+
+	if d := lc.Duration("Timeout", 5); d != 5 {
+		t.Errorf("Duration: got %s, expected default", d)
+	}
+	if addr := lc.HostPort("LocalAddr", ""); addr != "0.0.0.0:1252" {
+		t.Errorf("HostPort: got %q", addr)
+	}
+}
+
+func TestSections(t *testing.T) {
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(`DestAddr="1.1.1.1:80";
+RelayMethod="GET";
+RelayMethod="POST, PUT";
+DestAddr="2.2.2.2:80";
+
+[upstream.a]
+DestAddr="3.3.3.3:80";
+[upstream.b];
+DestAddr="4.4.4.4:80";
+[upstream.a]
+Headers="X-A: 1\r\n";
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := lc.String("DestAddr", ""); addr != "2.2.2.2:80" {
+		t.Errorf("last value should win, got %q", addr)
+	}
+	if values := lc.Values("DestAddr"); len(values) != 2 || values[0] != "1.1.1.1:80" {
+		t.Errorf("Values: got %q", values)
+	}
+	if list := lc.List("RelayMethod", nil); strings.Join(list, " ") != "GET POST PUT" {
+		t.Errorf("List: got %q", list)
+	}
+	if names := lc.Sections(); strings.Join(names, " ") != "upstream.a upstream.b" {
+		t.Errorf("Sections: got %q", names)
+	}
+
+	a := lc.Section("upstream.a")
+	if a.String("DestAddr", "") != "3.3.3.3:80" || a.String("Headers", "") != "X-A: 1\r\n" {
+		t.Errorf("section upstream.a: %q", a.Keys())
+	}
+	if missing := lc.Section("missing"); missing.String("DestAddr", "def") != "def" {
+		t.Errorf("nil section should return default")
+	}
+
+	schema := lineconfig.Schema{
+		{Key: "DestAddr", Type: lineconfig.TypeHostPort},
+		{Key: "RelayMethod", Type: lineconfig.TypeList, Multiple: true},
+		{Key: "upstream", Type: lineconfig.TypeSection, Section: lineconfig.Schema{
+			{Key: "DestAddr", Type: lineconfig.TypeHostPort, Required: true},
+		}},
+	}
+	el, _ := lc.Validate(schema).(lineconfig.ErrorList)
+	// 重复的 DestAddr 使用最后一个值, 不报错
+	if len(el) != 1 || el[0].Key != "upstream.a.Headers" {
+		t.Errorf("unexpected errors:\n%s", el)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lineconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.conf":            "LocalAddr=\"0.0.0.0:1252\";\ninclude \"headers/carrier.conf\";\n[upstream.a]\ninclude 'addr.conf';\n",
+		"headers/carrier.conf": "Headers=\"X-Carrier: 1\\r\\n\";\n",
+		"addr.conf":            "DestAddr=\"${TEST_LINECONFIG_HOST:-10.0.0.172}:${TEST_LINECONFIG_PORT}\";\nPrice=\"$${NOT_EXPANDED}\";\n",
+		"cycle1.conf":          "include \"cycle2.conf\";\n",
+		"cycle2.conf":          "include \"cycle1.conf\";\n",
+	}
+	for name, content := range files {
+		fPath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fPath), 0755)
+		err = ioutil.WriteFile(fPath, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Setenv("TEST_LINECONFIG_PORT", "80")
+	defer os.Unsetenv("TEST_LINECONFIG_PORT")
+
+	lc := lineconfig.NewLineConfig()
+	err = lc.LoadFrom(filepath.Join(dir, "main.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := lc.String("Headers", ""); h != "X-Carrier: 1\r\n" {
+		t.Errorf("Headers: got %q", h)
+	}
+	a := lc.Section("upstream.a")
+	if addr := a.String("DestAddr", ""); addr != "10.0.0.172:80" {
+		t.Errorf("DestAddr: got %q", addr)
+	}
+	if price := a.String("Price", ""); price != "${NOT_EXPANDED}" {
+		t.Errorf("Price: got %q", price)
+	}
+
+	err = lineconfig.NewLineConfig().LoadFrom(filepath.Join(dir, "cycle1.conf"))
+	el, ok := err.(lineconfig.ErrorList)
+	if !ok || len(el) != 1 || !strings.Contains(el[0].Reason, "include cycle") {
+		t.Errorf("expected include cycle error, got %v", err)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("TEST_LINECONFIG_SET", "value")
+	os.Setenv("TEST_LINECONFIG_EMPTY", "")
+	defer os.Unsetenv("TEST_LINECONFIG_SET")
+	defer os.Unsetenv("TEST_LINECONFIG_EMPTY")
+
+	for value, want := range map[string]string{
+		"${TEST_LINECONFIG_SET}":               "value",
+		"a${TEST_LINECONFIG_SET}b":             "avalueb",
+		"${TEST_LINECONFIG_UNSET}":             "",
+		"${TEST_LINECONFIG_UNSET:-def}":        "def",
+		"${TEST_LINECONFIG_EMPTY:-def}":        "def",
+		"${TEST_LINECONFIG_SET:-def}":          "value",
+		"$${TEST_LINECONFIG_SET}":              "${TEST_LINECONFIG_SET}",
+		"$${not a var} ${TEST_LINECONFIG_SET}": "${not a var} value",
+		"$HOME $ {} {x}":                       "$HOME $ {} {x}",
+	} {
+		lc := lineconfig.NewLineConfig()
+		if err := lc.ParseFromReader(strings.NewReader("A=\"" + value + "\";")); err != nil {
+			t.Errorf("%s: %s", value, err)
+			continue
+		}
+		if got := lc.String("A", ""); got != want {
+			t.Errorf("%s: got %q, want %q", value, got, want)
+		}
+	}
+
+	// 旧配置中字面的 ${ 需要改为 $${
+	for _, value := range []string{"${not a var}", "${UNTERMINATED"} {
+		lc := lineconfig.NewLineConfig()
+		if err := lc.ParseFromReader(strings.NewReader("A=\"" + value + "\";")); err == nil {
+			t.Errorf("%s: expected error, got %q", value, lc.String("A", ""))
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	src := `# listen;
+LocalAddr="0.0.0.0:1252"; # all interfaces;
+DestAddr='${TEST_LINECONFIG_UNSET:-10.0.0.172}:80';
+Obsolete="x";
+Headers="X-A: 1\r\n";
+
+# upstreams;
+[upstream.a]
+DestAddr="1.1.1.1:80";
+`
+	lc := lineconfig.NewLineConfig()
+	err := lc.ParseFromReader(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	_, err = lc.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != src {
+		t.Fatalf("unmodified config should be written as is, got:\n%s", b.String())
+	}
+
+	lc.Set("LocalAddr", "127.0.0.1:1252")
+	lc.Delete("Obsolete")
+	lc.Add("RelayMethod", "GET")
+	lc.Section("upstream.a").Add("Headers", "X-B: \"quoted\" ${HOME}\r\n")
+	lc.AddSection("upstream.b").Set("DestAddr", "2.2.2.2:80")
+
+	b.Reset()
+	_, err = lc.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `# listen;
+LocalAddr="127.0.0.1:1252"; # all interfaces;
+DestAddr='${TEST_LINECONFIG_UNSET:-10.0.0.172}:80';
+Headers="X-A: 1\r\n";
+RelayMethod="GET";
+
+# upstreams;
+[upstream.a]
+DestAddr="1.1.1.1:80";
+Headers="X-B: \"quoted\" $${HOME}\r\n";
+
+[upstream.b]
+DestAddr="2.2.2.2:80";
+`
+	if b.String() != expected {
+		t.Fatalf("got:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+
+	reread := lineconfig.NewLineConfig()
+	err = reread.ParseFromReader(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := reread.Section("upstream.a").String("Headers", ""); h != "X-B: \"quoted\" ${HOME}\r\n" {
+		t.Errorf("round trip: got %q", h)
+	}
+
+	// 注释到下一个分号, 新增的分组不能写在未结束的注释中
+	lc = lineconfig.NewLineConfig()
+	err = lc.ParseFromReader(strings.NewReader("A=\"1\";\n# no semicolon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.AddSection("s").Set("B", "2")
+	b.Reset()
+	_, err = lc.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread = lineconfig.NewLineConfig()
+	err = reread.ParseFromReader(strings.NewReader(b.String()))
+	if err != nil || reread.Section("s").String("B", "") != "2" {
+		t.Errorf("new section written into a comment:\n%s", b.String())
+	}
+}
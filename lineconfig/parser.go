@@ -0,0 +1,400 @@
+package lineconfig
+
+import (
+	"fmt"
+	"github.com/iikira/BaiduPCS-Go/pcsliner/args"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type (
+	// ParseError 配置解析错误, 带有出错的位置
+	ParseError struct {
+		File   string
+		Line   int // 从1开始, 0 表示位置未知
+		Column int // 从1开始, 按字符计
+		Key    string
+		Reason string
+		Err    error // 原始错误
+	}
+
+	// ErrorList 解析过程中收集到的全部错误
+	ErrorList []*ParseError
+
+	parser struct {
+		src   []rune
+		pos   int
+		line  int
+		col   int
+		file  string
+		errs  ErrorList
+		root  *LineConfig
+		cur   *LineConfig // 当前所在的分组
+		stack []string    // 正在解析的文件, 用于检测循环 include
+
+		included bool // 是否为 include 的文件
+
+		// 以下用于保留原文, 只记录最外层的文件
+		record      bool
+		lastEntry   *entry
+		lastSection *LineConfig
+	}
+)
+
+const (
+	eof = -1
+)
+
+func (pe *ParseError) Error() string {
+	var b strings.Builder
+	if pe.File != "" {
+		b.WriteString(pe.File)
+		b.WriteByte(':')
+	}
+	if pe.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", pe.Line, pe.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	if pe.Key != "" {
+		b.WriteString(pe.Key)
+		b.WriteString(": ")
+	}
+	b.WriteString(pe.Reason)
+	if pe.Err != nil && pe.Err != ErrSyntax {
+		b.WriteString(": ")
+		b.WriteString(pe.Err.Error())
+	}
+	return b.String()
+}
+
+func (el ErrorList) Error() string {
+	s := make([]string, len(el))
+	for k := range el {
+		s[k] = el[k].Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Err 没有错误时返回 nil
+func (el ErrorList) Err() error {
+	if len(el) == 0 {
+		return nil
+	}
+	return el
+}
+
+// sort 按位置排序, 位置相同时按 key 排序
+func (el ErrorList) sort() {
+	sort.SliceStable(el, func(i, j int) bool {
+		a, b := el[i], el[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Key < b.Key
+	})
+}
+
+func newParser(reader io.Reader, file string) (*parser, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{
+		src:  []rune(string(data)),
+		line: 1,
+		col:  1,
+		file: file,
+	}, nil
+}
+
+func (p *parser) peek() rune {
+	if p.pos >= len(p.src) {
+		return eof
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) next() rune {
+	r := p.peek()
+	if r == eof {
+		return eof
+	}
+	p.pos++
+	if r == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	return r
+}
+
+func (p *parser) errorf(line, col int, key string, err error, format string, a ...interface{}) {
+	p.errs = append(p.errs, &ParseError{
+		File:   p.file,
+		Line:   line,
+		Column: col,
+		Key:    key,
+		Reason: fmt.Sprintf(format, a...),
+		Err:    err,
+	})
+}
+
+// skipBlank 跳过同一行内的空白
+func (p *parser) skipBlank() {
+	for r := p.peek(); r == ' ' || r == '\t' || r == '\r'; r = p.peek() {
+		p.next()
+	}
+}
+
+// skipStatement 出错后跳到下一条语句
+func (p *parser) skipStatement() {
+	for r := p.peek(); r != eof; r = p.peek() {
+		p.next()
+		if r == ';' || r == '\n' {
+			return
+		}
+	}
+}
+
+func (p *parser) skipComment() {
+	for r := p.peek(); r != eof; r = p.peek() {
+		p.next()
+		if r == ';' {
+			return
+		}
+	}
+}
+
+func (p *parser) parse() {
+	triviaStart := p.pos
+	for {
+		r := p.peek()
+		switch {
+		case r == eof:
+			p.addNode(triviaStart)
+			return
+		case unicode.IsSpace(r), r == ';':
+			p.next()
+		case r == '#': // 注释, 与旧版本相同, 到下一个分号, 可以跨行
+			p.skipComment()
+		default:
+			p.addNode(triviaStart)
+			start := p.pos
+			p.lastEntry, p.lastSection = nil, nil
+			switch {
+			case r == '[':
+				p.parseSection()
+			case p.isInclude():
+				p.parseInclude()
+			default:
+				p.parseEntry()
+			}
+			p.addNode(start)
+			triviaStart = p.pos
+		}
+	}
+}
+
+// addNode 记录从 start 到当前位置的原文
+func (p *parser) addNode(start int) {
+	if !p.record || start == p.pos {
+		return
+	}
+	n := &node{
+		text:    string(p.src[start:p.pos]),
+		entry:   p.lastEntry,
+		section: p.lastSection,
+	}
+	if n.entry != nil {
+		n.entry.inDoc = true
+	}
+	p.root.doc = append(p.root.doc, n)
+	p.lastEntry, p.lastSection = nil, nil
+}
+
+// parseEntry 解析 key=value;, 与旧版本相同, key 可以为 = 之前的任意内容, 由 Schema 检查
+func (p *parser) parseEntry() {
+	line, col := p.line, p.col
+	var key strings.Builder
+	for {
+		r := p.peek()
+		if r == '=' {
+			p.next()
+			break
+		}
+		if r == eof || r == ';' || r == '\n' {
+			p.errorf(line, col, strings.TrimSpace(key.String()), ErrSyntax, "missing '='")
+			p.skipStatement()
+			return
+		}
+		key.WriteRune(p.next())
+	}
+
+	k := strings.TrimSpace(key.String())
+	if k == "" {
+		p.errorf(line, col, "", ErrSyntax, "missing key")
+		p.skipStatement()
+		return
+	}
+
+	p.skipBlank()
+	vline, vcol := p.line, p.col
+	raw, ok := p.scanValue(k)
+	if !ok {
+		return
+	}
+
+	value, err := strconv.Unquote("\"" + raw + "\"")
+	if err != nil {
+		p.errorf(vline, vcol, k, err, "invalid value")
+		return
+	}
+	value, err = expandEnv(value)
+	if err != nil {
+		p.errorf(vline, vcol, k, err, "invalid value")
+		return
+	}
+	p.lastEntry = &entry{
+		key:      k,
+		value:    value,
+		pos:      p.position(line, col),
+		included: p.included,
+	}
+	p.cur.entries = append(p.cur.entries, p.lastEntry)
+}
+
+// parseSection 解析 [name], 同名分组合并
+func (p *parser) parseSection() {
+	line, col := p.line, p.col
+	p.next() // [
+	var name strings.Builder
+	for {
+		r := p.peek()
+		if r == ']' {
+			p.next()
+			break
+		}
+		if r == eof || r == ';' || r == '\n' {
+			p.errorf(line, col, "", ErrSyntax, "missing ']'")
+			p.skipStatement()
+			return
+		}
+		name.WriteRune(p.next())
+	}
+
+	n := strings.TrimSpace(name.String())
+	if !isValidSectionName(n) {
+		p.errorf(line, col, "", ErrSyntax, "invalid section name %q", n)
+		p.cur = &LineConfig{name: n} // 丢弃该分组下的内容
+		return
+	}
+
+	p.cur = p.root.Section(n)
+	if p.cur == nil {
+		p.cur = p.root.AddSection(n)
+		p.cur.pos = p.position(line, col)
+	}
+	p.lastSection = p.cur
+}
+
+func (p *parser) position(line, col int) position {
+	return position{
+		file:   p.file,
+		line:   line,
+		column: col,
+	}
+}
+
+// scanValue 读取值的原始内容, 并消耗结尾的分号
+func (p *parser) scanValue(key string) (raw string, ok bool) {
+	var (
+		b          strings.Builder
+		line, col  = p.line, p.col
+		quote      rune
+		terminated bool
+	)
+	if args.IsQuote(p.peek()) {
+		quote = p.next()
+	}
+
+	for {
+		r := p.peek()
+		if quote == 0 && (r == ';' || r == '\n' || r == eof) {
+			break
+		}
+		if quote != 0 && (r == '\n' || r == eof) {
+			p.errorf(line, col, key, ErrSyntax, "unterminated string")
+			p.skipStatement()
+			return "", false
+		}
+
+		p.next()
+		if quote != 0 && r == quote {
+			terminated = true
+			break
+		}
+		b.WriteRune(r)
+		if r == args.CharEscape && p.peek() != eof && p.peek() != '\n' {
+			b.WriteRune(p.next())
+		}
+	}
+
+	if terminated {
+		p.skipBlank()
+	}
+	switch r := p.peek(); r {
+	case ';':
+		p.next()
+	case eof:
+	case '\n':
+		p.errorf(p.line, p.col, key, ErrSyntax, "missing ';'")
+		p.next()
+		return "", false
+	default:
+		p.errorf(p.line, p.col, key, ErrSyntax, "unexpected %q after value", r)
+		p.skipStatement()
+		return "", false
+	}
+
+	raw = b.String()
+	if quote == 0 {
+		raw = strings.TrimSpace(raw)
+	}
+	return raw, true
+}
+
+// isValidSectionName 分组名可以用 . 分隔, 如 listener.web
+func isValidSectionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, part := range strings.Split(name, ".") {
+		if part == "" || !isValidKey(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidKey 分组名的每一部分只能包含字母, 数字, _ 和 -
+func isValidKey(key string) bool {
+	for _, r := range key {
+		if r != '_' && r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
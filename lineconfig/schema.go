@@ -0,0 +1,210 @@
+package lineconfig
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Type 配置值的类型
+	Type int
+
+	// Field 配置项的定义
+	Field struct {
+		Key      string
+		Type     Type
+		Required bool
+		// Multiple 表示 key 可以出现多次, 所有值都有效.
+		// 其他 key 重复时不报错, 与旧版本相同只使用最后一个值
+		Multiple bool
+		// Secret 值为密码等敏感信息, 输出时应隐藏
+		Secret bool
+		// Section 为 TypeSection 时分组内允许的配置项,
+		// Key 为 listener 时匹配 [listener] 和 [listener.xxx]
+		Section Schema
+		// Check 额外的校验, 在类型校验通过后调用
+		Check func(value string) error
+	}
+
+	// Schema 声明允许出现的配置项, 未声明的 key 和分组视为错误
+	Schema []Field
+)
+
+const (
+	TypeString Type = iota
+	TypeInt
+	TypeBool
+	TypeDuration
+	TypeList
+	TypeHostPort
+	TypeSection
+)
+
+var (
+	ErrInvalidPort = errors.New("invalid port")
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeInt:
+		return "int"
+	case TypeBool:
+		return "bool"
+	case TypeDuration:
+		return "duration"
+	case TypeList:
+		return "list"
+	case TypeHostPort:
+		return "host:port"
+	case TypeSection:
+		return "section"
+	}
+	return "Type(" + strconv.Itoa(int(t)) + ")"
+}
+
+func (t Type) check(value string) error {
+	value = strings.TrimSpace(value)
+	var err error
+	switch t {
+	case TypeInt:
+		_, err = strconv.Atoi(value)
+	case TypeBool:
+		_, err = strconv.ParseBool(value)
+	case TypeDuration:
+		_, err = time.ParseDuration(value)
+	case TypeHostPort:
+		err = checkHostPort(value)
+	}
+	return err
+}
+
+func (s Schema) field(key string) *Field {
+	for k := range s {
+		if s[k].Key == key && s[k].Type != TypeSection {
+			return &s[k]
+		}
+	}
+	return nil
+}
+
+func (s Schema) sectionField(name string) *Field {
+	for k := range s {
+		if s[k].Type == TypeSection && sectionMatch(s[k].Key, name) {
+			return &s[k]
+		}
+	}
+	return nil
+}
+
+// Lookup 查找 key 对应的定义, 分组内的 key 写作 listener.web.LocalAddr
+func (s Schema) Lookup(key string) *Field {
+	i := strings.LastIndexByte(key, '.')
+	if i < 0 {
+		return s.field(key)
+	}
+	f := s.sectionField(key[:i])
+	if f == nil {
+		return nil
+	}
+	return f.Section.field(key[i+1:])
+}
+
+func sectionMatch(kind, name string) bool {
+	return name == kind || strings.HasPrefix(name, kind+".")
+}
+
+// Validate 按 schema 校验配置: 未知的 key 和分组, 缺少的必填项, 以及值的格式
+func (lc *LineConfig) Validate(s Schema) error {
+	var errs ErrorList
+	lc.validate(s, &errs)
+	errs.sort()
+	return errs.Err()
+}
+
+func (lc *LineConfig) validate(s Schema, errs *ErrorList) {
+	count := map[string]int{}
+	for _, e := range lc.entries {
+		f := s.field(e.key)
+		if f == nil {
+			*errs = append(*errs, e.pos.error(lc.qualify(e.key), s.unknownKeyReason(e.key), nil))
+			continue
+		}
+
+		count[e.key]++
+
+		err := f.Type.check(e.value)
+		if err == nil && f.Check != nil {
+			err = f.Check(e.value)
+		}
+		if err != nil {
+			*errs = append(*errs, e.pos.error(lc.qualify(e.key), "invalid "+f.Type.String(), err))
+		}
+	}
+
+	for _, sec := range lc.sections {
+		f := s.sectionField(sec.name)
+		if f == nil {
+			*errs = append(*errs, sec.pos.error("["+sec.name+"]", "unknown section", nil))
+			continue
+		}
+		sec.validate(f.Section, errs)
+	}
+
+	for _, f := range s {
+		if !f.Required {
+			continue
+		}
+		if f.Type == TypeSection {
+			if !lc.hasSection(f.Key) {
+				*errs = append(*errs, lc.pos.error("["+f.Key+"]", "missing required section", nil))
+			}
+			continue
+		}
+		if count[f.Key] == 0 {
+			*errs = append(*errs, lc.pos.error(lc.qualify(f.Key), "missing required key", nil))
+		}
+	}
+}
+
+func (lc *LineConfig) hasSection(kind string) bool {
+	for _, sec := range lc.sections {
+		if sectionMatch(kind, sec.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// qualify 分组内的 key 加上分组名, 如 listener.web.LocalAddr
+func (lc *LineConfig) qualify(key string) string {
+	if lc.name == "" {
+		return key
+	}
+	return lc.name + "." + key
+}
+
+func (pos position) error(key, reason string, err error) *ParseError {
+	return &ParseError{
+		File:   pos.file,
+		Line:   pos.line,
+		Column: pos.column,
+		Key:    key,
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+func (s Schema) unknownKeyReason(key string) string {
+	reason := "unknown key"
+	for _, f := range s {
+		if f.Type != TypeSection && strings.EqualFold(f.Key, key) {
+			reason += ", did you mean " + f.Key + "?"
+			break
+		}
+	}
+	return reason
+}
@@ -0,0 +1,140 @@
+package lineconfig
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// configWriter 记录写入的字节数和最后一个字符
+	configWriter struct {
+		w    *bufio.Writer
+		n    int64
+		last byte
+	}
+)
+
+func (cw *configWriter) WriteString(s string) {
+	if s == "" {
+		return
+	}
+	n, _ := cw.w.WriteString(s)
+	cw.n += int64(n)
+	cw.last = s[len(s)-1]
+}
+
+// QuoteValue 将值转换为 "..." 形式, 解析后得到原值
+func QuoteValue(value string) string {
+	return strings.Replace(strconv.Quote(value), "${", "$${", -1)
+}
+
+func formatEntry(e *entry) string {
+	return e.key + "=" + QuoteValue(e.value) + ";"
+}
+
+// WriteTo 以 key="value"; 的格式写出配置.
+// 对于读取自文件的配置, 保留原有的注释, 空白和顺序, 未修改的配置原样写出,
+// 新增的 key 写在所在分组的最后一条配置之后, 新增的分组写在末尾.
+// include 的文件不会被写出, 其中被 Set 修改的 key 写入当前文件.
+func (lc *LineConfig) WriteTo(w io.Writer) (n int64, err error) {
+	cw := &configWriter{
+		w: bufio.NewWriter(w),
+	}
+
+	// 每个分组中, 新增配置写在哪个 node 之后
+	anchors := map[*LineConfig]*node{}
+	cur := lc
+	for _, nd := range lc.doc {
+		switch {
+		case nd.section != nil:
+			cur = nd.section
+			if anchors[cur] == nil {
+				anchors[cur] = nd
+			}
+		case nd.entry != nil && !nd.entry.deleted:
+			anchors[cur] = nd
+		}
+	}
+
+	var (
+		written  = map[*LineConfig]bool{}
+		trimNext bool
+	)
+	writePending := func(sec *LineConfig, prefix, suffix string) {
+		written[sec] = true
+		for _, e := range sec.entries {
+			if e.inDoc || e.included {
+				continue
+			}
+			cw.WriteString(prefix)
+			cw.WriteString(formatEntry(e))
+			cw.WriteString(suffix)
+		}
+	}
+
+	if anchors[lc] == nil {
+		writePending(lc, "", "\n")
+	}
+	for _, nd := range lc.doc {
+		switch {
+		case nd.entry != nil && nd.entry.deleted:
+			trimNext = true
+			continue
+		case nd.entry != nil && nd.entry.dirty:
+			cw.WriteString(formatEntry(nd.entry))
+		case trimNext && nd.entry == nil && nd.section == nil:
+			// 删除配置后, 去掉同一行剩余的换行
+			text := strings.TrimLeft(nd.text, " \t\r")
+			if strings.HasPrefix(text, "\n") {
+				text = text[1:]
+			}
+			cw.WriteString(text)
+		default:
+			cw.WriteString(nd.text)
+		}
+		trimNext = false
+
+		for sec, anchor := range anchors {
+			if anchor == nd && !written[sec] {
+				writePending(sec, "\n", "")
+			}
+		}
+	}
+
+	openComment := endsInComment(lc.doc)
+	for _, sec := range lc.sections {
+		if written[sec] {
+			continue
+		}
+		if openComment {
+			cw.WriteString(";")
+			openComment = false
+		}
+		if cw.n > 0 {
+			if cw.last != '\n' {
+				cw.WriteString("\n")
+			}
+			cw.WriteString("\n")
+		}
+		cw.WriteString("[" + sec.name + "]\n")
+		writePending(sec, "", "\n")
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// endsInComment 原文以没有分号的注释结束, 之后写入的分组会成为注释的一部分.
+// 注释和空白之外的内容都在 entry 和 section 的 node 中, 最后一个分号之后的 # 即为未结束的注释.
+func endsInComment(doc []*node) bool {
+	if len(doc) == 0 {
+		return false
+	}
+	nd := doc[len(doc)-1]
+	if nd.entry != nil || nd.section != nil {
+		return false
+	}
+	text := nd.text[strings.LastIndexByte(nd.text, ';')+1:]
+	return strings.IndexByte(text, '#') >= 0
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type (
+	// listenerDef 一个监听的配置, 顶层配置为名为 default 的监听
+	listenerDef struct {
+		name string
+		sec  *lineconfig.LineConfig
+	}
+)
+
+const (
+	defaultName     = "default"
+	connectLazy     = "lazy"
+	connectStrict   = "strict"
+	listenerSection = "listener"
+	upstreamSection = "upstream"
+)
+
+var (
+	ErrInvalidAuth       = errors.New("should be username:password")
+	ErrInvalidSocketMode = errors.New("should be an octal permission such as 0660")
+	ErrInvalidReply      = errors.New("should be lazy or strict")
+)
+
+func checkMode(value string) error {
+	_, err := tunnelclient.ParseServMode(strings.TrimSpace(value))
+	return err
+}
+
+func checkConnectReply(value string) error {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case connectLazy, connectStrict:
+		return nil
+	}
+	return ErrInvalidReply
+}
+
+func checkAuth(value string) error {
+	for _, user := range strings.Split(value, ",") {
+		user = strings.TrimSpace(user)
+		if user == "" {
+			continue
+		}
+		if i := strings.IndexByte(user, ':'); i <= 0 {
+			return ErrInvalidAuth
+		}
+	}
+	return nil
+}
+
+// checkSocketMode unix socket 的权限, 八进制, 如 0660
+func checkSocketMode(value string) error {
+	_, err := parseSocketMode(value)
+	return err
+}
+
+func parseSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0777 {
+		return 0, ErrInvalidSocketMode
+	}
+	return os.FileMode(mode), nil
+}
+
+// sectionSuffix listener.web 返回 web
+func sectionSuffix(kind, name string) string {
+	if name == kind {
+		return kind
+	}
+	return strings.TrimPrefix(name, kind+".")
+}
+
+// listenerDefs 返回所有监听, 顶层有 LocalAddr 时包括默认监听
+func listenerDefs(c *lineconfig.LineConfig) []listenerDef {
+	var defs []listenerDef
+	if _, ok := c.Get("LocalAddr"); ok {
+		defs = append(defs, listenerDef{
+			name: defaultName,
+			sec:  c,
+		})
+	}
+	for _, name := range c.Sections() {
+		if name != listenerSection && !strings.HasPrefix(name, listenerSection+".") {
+			continue
+		}
+		defs = append(defs, listenerDef{
+			name: sectionSuffix(listenerSection, name),
+			sec:  c.Section(name),
+		})
+	}
+	return defs
+}
+
+// upstreamConfig 返回名为 name 的上游, name 为空时为顶层的默认上游
+func upstreamConfig(c *lineconfig.LineConfig, name string) *lineconfig.LineConfig {
+	if name == "" {
+		return c
+	}
+	return c.Section(upstreamSection + "." + name)
+}
+
+// hasUpstream 上游设置了 DestAddr 或 Chain
+func hasUpstream(up *lineconfig.LineConfig) bool {
+	if _, ok := up.Get("DestAddr"); ok {
+		return true
+	}
+	_, ok := up.Get("Chain")
+	return ok
+}
+
+// upstreamNames 返回所有可用的上游, 默认上游为空字符串
+func upstreamNames(c *lineconfig.LineConfig) []string {
+	var names []string
+	if hasUpstream(c) {
+		names = append(names, "")
+	}
+	for _, name := range c.Sections() {
+		if strings.HasPrefix(name, upstreamSection+".") {
+			names = append(names, strings.TrimPrefix(name, upstreamSection+"."))
+		}
+	}
+	return names
+}
+
+// validateListeners 检查监听的数量, 名称和引用的上游
+func validateListeners(c *lineconfig.LineConfig) error {
+	var errs lineconfig.ErrorList
+	defs := listenerDefs(c)
+	if len(defs) == 0 {
+		errs = append(errs, &lineconfig.ParseError{
+			Key:    "LocalAddr",
+			Reason: "no listener, set LocalAddr or add a [listener.name] section",
+		})
+	}
+
+	// [listener.default] 与顶层的默认监听同名
+	seen := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		if seen[def.name] {
+			errs = append(errs, &lineconfig.ParseError{
+				Key:    def.name,
+				Reason: "duplicate listener name " + def.name,
+			})
+		}
+		seen[def.name] = true
+	}
+
+	for _, def := range defs {
+		upstream := def.sec.String("Upstream", "")
+		up := upstreamConfig(c, upstream)
+		if up != nil && hasUpstream(up) {
+			continue
+		}
+		reason := "unknown upstream " + upstream
+		if upstream == "" {
+			reason = "missing DestAddr for the default upstream"
+		}
+		errs = append(errs, &lineconfig.ParseError{
+			Key:    def.name,
+			Reason: reason,
+		})
+	}
+	for _, def := range defs {
+		reason := checkRelayUpstream(c, strings.TrimSpace(listenerValue(c, def, "RelayUpstream")))
+		if reason != "" {
+			errs = append(errs, &lineconfig.ParseError{
+				Key:    def.name,
+				Reason: reason,
+			})
+		}
+	}
+	errs = append(errs, validateUpstreams(c)...)
+	return errs.Err()
+}
+
+// newServer 按配置创建所有监听
+func newServer(c *lineconfig.LineConfig) *tunnelclient.Server {
+	srv := tunnelclient.NewServer()
+	applyGlobalRate(srv, c)
+	for _, def := range listenerDefs(c) {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		applyListener(tc, c, def)
+		srv.Add(tc)
+	}
+	return srv
+}
+
+// applyGlobalRate 设置所有监听共享的限速
+func applyGlobalRate(srv *tunnelclient.Server, c *lineconfig.LineConfig) {
+	rate, _ := parseRate(c.String("GlobalRateLimit", "0"))
+	srv.SetRateLimit(rate)
+}
+
+// applyListener 将监听的配置写入 tc, 运行中调用时需在 tc.Update 内进行
+func applyListener(tc *tunnelclient.TunnelHTTPClient, c *lineconfig.LineConfig, def listenerDef) {
+	tc.Name = def.name
+	tc.LocalAddr = strings.TrimSpace(def.sec.String("LocalAddr", ""))
+	tc.SocketMode, _ = parseSocketMode(def.sec.String("SocketMode", "0"))
+	tc.SocketOwner = def.sec.String("SocketOwner", "")
+	tc.Mode, _ = tunnelclient.ParseServMode(def.sec.String("Mode", "http"))
+
+	tc.SetRelayMethod(listenerValue(c, def, "RelayMethod"))
+	tc.SetAuth(parseAuth(def.sec.List("Auth", nil)))
+	applyUpstream(tc, c, upstreamConfig(c, def.sec.String("Upstream", "")))
+	applyRelayUpstream(tc, c, def)
+	tc.SetRelayAbsoluteURI(def.sec.Bool("RelayAbsoluteURI", c.Bool("RelayAbsoluteURI", false)))
+	tc.SetRateLimit(listenerRate(c, def, "RateLimit"), listenerRate(c, def, "UserRateLimit"), listenerRate(c, def, "IPRateLimit"))
+	tc.SetConnLimit(listenerInt(c, def, "MaxConns"), listenerInt(c, def, "MaxConnsPerIP"))
+
+	allow, _ := tunnelclient.ParseIPList(listenerList(c, def, "AllowClient"))
+	deny, _ := tunnelclient.ParseIPList(listenerList(c, def, "DenyClient"))
+	tc.SetClientACL(allow, deny)
+	tc.SetDestPolicy(destPolicy(c, def))
+	tc.SetErrorPage(errorPage(c, def))
+	tc.SetStrictConnect(strings.EqualFold(strings.TrimSpace(listenerValue(c, def, "ConnectReply")), connectStrict))
+	tc.SetDialer(bindDialer(c, def))
+}
+
+// listenerValue 监听没有设置时使用顶层的值
+func listenerValue(c *lineconfig.LineConfig, def listenerDef, key string) string {
+	value, ok := def.sec.Get(key)
+	if !ok {
+		value = c.String(key, "")
+	}
+	return value
+}
+
+// listenerList 监听没有设置时使用顶层的列表
+func listenerList(c *lineconfig.LineConfig, def listenerDef, key string) []string {
+	if _, ok := def.sec.Get(key); ok {
+		return def.sec.List(key, nil)
+	}
+	return c.List(key, nil)
+}
+
+// checkIPList 逗号分隔的 CIDR 或 IP
+func checkIPList(value string) error {
+	_, err := tunnelclient.ParseIPList(strings.Split(value, ","))
+	return err
+}
+
+// applyRelayUpstream 设置 RelayMethod 请求的上游, RelayUpstream 为空时与隧道相同.
+// RelayHeaders 为空时使用该上游的 Headers, 该上游有 Auth 时加上 Basic 认证, direct 时不添加请求头.
+func applyRelayUpstream(tc *tunnelclient.TunnelHTTPClient, c *lineconfig.LineConfig, def listenerDef) {
+	var (
+		name        = strings.TrimSpace(listenerValue(c, def, "RelayUpstream"))
+		headers, ok = def.sec.Get("RelayHeaders")
+	)
+	if !ok {
+		headers, ok = c.Get("RelayHeaders")
+	}
+	headersFunc := func(host []byte) string {
+		return headers
+	}
+
+	switch name {
+	case "":
+		tc.SetRelayUpstream("")
+	case tunnelclient.RelayDirect:
+		tc.SetRelayUpstream(tunnelclient.RelayDirect)
+		ok = true
+	default:
+		hop := newHop(upstreamConfig(c, name))
+		tc.SetRelayUpstream(hop.Addr)
+		if ok {
+			hop.Headers = headersFunc
+		}
+		tc.SetRelayHeadersFunc(hop.ProxyHeaders)
+		return
+	}
+
+	if !ok {
+		tc.SetRelayHeadersFunc(nil)
+		return
+	}
+	tc.SetRelayHeadersFunc(headersFunc)
+}
+
+// applyUpstream 设置 tc 使用的上游, 直连的 RelayMethod 请求发往第一个代理
+func applyUpstream(tc *tunnelclient.TunnelHTTPClient, c, up *lineconfig.LineConfig) {
+	hops := upstreamHops(c, up)
+	tc.DestAddr = hops[0].Addr
+	tc.SetHeadersFunc(hops[0].Headers)
+	tc.SetChain(hops)
+}
+
+func parseAuth(list []string) map[string]string {
+	if len(list) == 0 {
+		return nil
+	}
+	users := make(map[string]string, len(list))
+	for _, user := range list {
+		s := strings.SplitN(user, ":", 2)
+		if len(s) == 2 {
+			users[s[0]] = s[1]
+		}
+	}
+	return users
+}
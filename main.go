@@ -2,45 +2,83 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/iikira/tcp_over_http_proxy/lineconfig"
-	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
-	"log"
+	"os"
+	"strings"
+)
+
+type (
+	command struct {
+		name  string
+		usage string
+		run   func(args []string) int
+	}
 )
 
 var (
 	configPath string
-	servType   tunnelclient.ServMode
-	lc         lineconfig.LineConfig
+	lc         *lineconfig.LineConfig
+
+	commands = []command{
+		{"serve", "run the proxy, the default command", runServe},
+		{"check", "parse and validate the config, exit non-zero on errors", runCheck},
+		{"probe", "CONNECT through each upstream to a target, print status and timing", runProbe},
+		{"version", "print build info", runVersion},
+	}
 )
 
-func init() {
-	flag.StringVar(&configPath, "c", "tcp_over_http_proxy.conf", "config path")
-	m := flag.String("m", "http", "serve mode, http or redirect")
-	flag.Parse()
-
-	switch *m {
-	case "http":
-		servType = tunnelclient.SERV_HTTP_PROXY
-	case "redirect":
-		servType = tunnelclient.SERV_REDIRECT
-	default:
-		log.Fatalln("unknown serve mode")
+func main() {
+	args := os.Args[1:]
+	name := "serve" // 兼容没有子命令的用法
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	lc = lineconfig.NewLineConfig()
-	err := lc.LoadFrom(configPath)
-	if err != nil {
-		log.Fatalf("load config error: %s\n", err)
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
+		}
 	}
-	log.Println(lc)
+
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+	}
+	usage()
+	os.Exit(2)
 }
 
-func main() {
-	tc := tunnelclient.NewTunnelHTTPClient()
-	tc.LocalAddr = lc["LocalAddr"]
-	tc.DestAddr = lc["DestAddr"]
-	tc.SetHeadersFunc(func(host []byte) string {
-		return lc["Headers"]
-	})
-	tc.SetRelayMethod(lc["RelayMethod"])
-	log.Fatalln(tc.ListenAndServe(servType))
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// configFlags 注册各命令共用的配置参数, 返回的函数在解析参数后调用
+func configFlags(fs *flag.FlagSet) func() error {
+	fs.StringVar(&configPath, "c", "tcp_over_http_proxy.conf", "config path")
+	fs.Var(&overrides, "set", "override a config key, Key=Value or section.name.Key=Value, repeatable")
+	localAddr := fs.String("local", "", "override LocalAddr")
+	destAddr := fs.String("dest", "", "override DestAddr")
+	headers := fs.String("headers", "", "override Headers, escapes such as \\r\\n are allowed")
+
+	return func() error {
+		// 单独的参数优先于 -set
+		for _, o := range []struct{ key, value string }{
+			{"LocalAddr", *localAddr},
+			{"DestAddr", *destAddr},
+			{"Headers", *headers},
+		} {
+			if o.value == "" {
+				continue
+			}
+			err := overrides.add(o.key, o.value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", o.key, err)
+			}
+		}
+		return nil
+	}
 }
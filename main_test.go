@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig 在临时目录中写入配置文件, 并重置命令行的覆盖
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "tcp_over_http_proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fPath := filepath.Join(dir, "test.conf")
+	err = ioutil.WriteFile(fPath, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides = nil
+	return fPath
+}
+
+func TestReload(t *testing.T) {
+	configPath = writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+
+[listener.socks]
+LocalAddr="127.0.0.1:1080";
+Mode="socks5";
+
+[listener.old]
+LocalAddr="127.0.0.1:1081";
+`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	var err error
+	lc, err = loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(lc)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// 修改上游, 监听地址和模式, 新增和删除监听
+	err = ioutil.WriteFile(configPath, []byte(`LocalAddr="127.0.0.1:1253";
+DestAddr="10.0.0.200:80";
+
+[listener.socks]
+LocalAddr="127.0.0.1:1080";
+Mode="mixed";
+Auth="alice:secret";
+
+[listener.new]
+LocalAddr="127.0.0.1:1082";
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reload(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := srv.Listener(defaultName)
+	if def.DestAddr != "10.0.0.200:80" {
+		t.Errorf("DestAddr not reloaded: %s", def.DestAddr)
+	}
+	if def.LocalAddr != "127.0.0.1:1252" {
+		t.Errorf("LocalAddr should need a restart, got %s", def.LocalAddr)
+	}
+	if socks := srv.Listener("socks"); socks.Mode.String() != "socks5" {
+		t.Errorf("Mode should need a restart, got %s", socks.Mode)
+	}
+	if srv.Listener("new") != nil {
+		t.Error("new listener should need a restart")
+	}
+	for _, msg := range []string{
+		"listener default changed to http 127.0.0.1:1253",
+		"listener socks changed to mixed",
+		"new listener new",
+		"listener old removed",
+	} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("missing log %q in:\n%s", msg, logs.String())
+		}
+	}
+
+	// 校验失败时保留旧配置
+	old := lc
+	err = ioutil.WriteFile(configPath, []byte(`LocalAddr="127.0.0.1:1253";
+DestAddr="not an address";
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reload(srv) == nil {
+		t.Error("expected error for an invalid config")
+	}
+	if lc != old || srv.Listener(defaultName).DestAddr != "10.0.0.200:80" {
+		t.Error("old config should be kept")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	fPath := writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+
+[listener.socks]
+LocalAddr="127.0.0.1:1080";
+`)
+	defer os.RemoveAll(filepath.Dir(fPath))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	applyFlags := configFlags(fs)
+	err := fs.Parse([]string{
+		"-c", fPath,
+		"-set", `Headers=X-Online-Host: example.com\r\n`,
+		"-set", "DestAddr=10.0.0.1:80",
+		"-dest", "10.0.0.200:80", // 单独的参数优先
+		"-set", "listener.socks.Mode=socks5",
+		"-set", "upstream.corp.DestAddr=10.1.1.1:3128", // 新的分组
+	})
+	if err == nil {
+		err = applyFlags()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"Headers":                "X-Online-Host: example.com\r\n",
+		"DestAddr":               "10.0.0.200:80",
+		"listener.socks.Mode":    "socks5",
+		"upstream.corp.DestAddr": "10.1.1.1:3128",
+	} {
+		sec, name := c, key
+		if i := strings.LastIndexByte(key, '.'); i >= 0 {
+			sec, name = c.Section(key[:i]), key[i+1:]
+		}
+		if got := sec.String(name, ""); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if got := c.Section("listener.socks").String("LocalAddr", ""); got != "127.0.0.1:1080" {
+		t.Errorf("other keys of the section should be kept, got %q", got)
+	}
+
+	// 覆盖后同样校验
+	overrides = nil
+	overrides.Set("listener.socks.Mode=nope")
+	if _, err := loadConfig(configPath); err == nil {
+		t.Error("expected error for an invalid override")
+	}
+	if err := overrides.Set(`Headers=bad \q escape`); err == nil {
+		t.Error("expected error for an invalid escape")
+	}
+	overrides = nil
+}
+
+func TestPrintConfig(t *testing.T) {
+	configPath = writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+Auth="alice:secret1";
+Headers="X-Online-Host: example.com\r\nProxy-Authorization: Basic secret2\r\n";
+RelayHeaders="authorization: Bearer secret3\r\n";
+
+[listener.socks]
+LocalAddr="127.0.0.1:1080";
+Auth="bob:secret4";
+RelayHeaders="Proxy-Authorization: Basic secret5\r\n";
+
+[upstream.corp]
+DestAddr="10.1.1.1:3128";
+Auth="carol:secret6";
+Headers="Proxy-Authorization: Basic secret7\r\n";
+`)
+	defer os.RemoveAll(filepath.Dir(configPath))
+
+	c, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = printConfig(&out, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("secrets not masked:\n%s", out.String())
+	}
+	for _, want := range []string{"X-Online-Host: example.com", "[upstream.corp]", "Proxy-Authorization: " + secretMask} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+	if c.String("Auth", "") != "alice:secret1" {
+		t.Error("printing should not change the config")
+	}
+}
+
+func TestCheckExitStatus(t *testing.T) {
+	good := writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+`)
+	defer os.RemoveAll(filepath.Dir(good))
+	bad := writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+Mode="nope";
+`)
+	defer os.RemoveAll(filepath.Dir(bad))
+
+	for _, test := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-c", good}, 0},
+		{[]string{"-c", good, "-set", "listener.socks.LocalAddr=127.0.0.1:1080"}, 0},
+		{[]string{"-c", bad}, 1},
+		{[]string{"-c", good, "-set", "Mode=nope"}, 1},
+		{[]string{"-c", filepath.Join(filepath.Dir(good), "missing.conf")}, 1},
+		{[]string{"-c", good, "-headers", `bad \q escape`}, 2},
+	} {
+		overrides = nil
+		if got := runCheck(test.args); got != test.want {
+			t.Errorf("check %q: got %d, want %d", test.args, got, test.want)
+		}
+	}
+	overrides = nil
+}
+
+func TestValidateListeners(t *testing.T) {
+	for content, want := range map[string]string{
+		`DestAddr="10.0.0.172:80";`: "no listener",
+		`[listener.a]
+LocalAddr="127.0.0.1:1080";
+Upstream="nope";`: "unknown upstream nope",
+		`[listener.a]
+LocalAddr="127.0.0.1:1080";`: "missing DestAddr for the default upstream",
+		`DestAddr="10.0.0.172:80";
+[listener.a]
+LocalAddr="127.0.0.1:1080";
+[listener.b]
+LocalAddr="127.0.0.1:1081";
+RelayUpstream="nope";`: "unknown RelayUpstream nope",
+		`DestAddr="10.0.0.172:80";
+[listener.a]
+Mode="socks5";`: "missing required key",
+		`LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+[listener.default]
+LocalAddr="127.0.0.1:1080";`: "duplicate listener name default",
+	} {
+		fPath := writeConfig(t, content)
+		_, err := loadConfig(fPath)
+		os.RemoveAll(filepath.Dir(fPath))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s\ngot %v, want %q", content, err, want)
+		}
+	}
+
+	fPath := writeConfig(t, `LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+
+[listener.socks]
+LocalAddr="127.0.0.1:1080";
+Mode="socks5";
+Auth="alice:secret";
+Upstream="corp";
+
+[listener.local]
+LocalAddr="unix:/run/proxy.sock";
+Mode="mixed";
+
+[upstream.corp]
+DestAddr="10.1.1.1:3128";
+`)
+	defer os.RemoveAll(filepath.Dir(fPath))
+	c, err := loadConfig(fPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(c)
+	for name, want := range map[string]string{
+		defaultName: "http 127.0.0.1:1252 10.0.0.172:80",
+		"socks":     "socks5 127.0.0.1:1080 10.1.1.1:3128",
+		"local":     "mixed unix:/run/proxy.sock 10.0.0.172:80",
+	} {
+		tc := srv.Listener(name)
+		if tc == nil {
+			t.Errorf("missing listener %s", name)
+			continue
+		}
+		if got := tc.Mode.String() + " " + tc.LocalAddr + " " + tc.DestAddr; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if n := len(srv.Listeners()); n != 3 {
+		t.Errorf("got %d listeners, want 3", n)
+	}
+}
+
+// TestReadmeConfig README 中配置格式的示例应能通过校验
+func TestReadmeConfig(t *testing.T) {
+	readme, err := ioutil.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(readme)
+	i := strings.Index(s, "# Config format")
+	if i < 0 {
+		t.Fatal("missing config format section")
+	}
+	s = s[i:]
+	i = strings.Index(s, "```\n")
+	j := strings.Index(s[i+4:], "```")
+	if i < 0 || j < 0 {
+		t.Fatal("missing config example")
+	}
+
+	fPath := writeConfig(t, s[i+4:i+4+j])
+	defer os.RemoveAll(filepath.Dir(fPath))
+	err = ioutil.WriteFile(filepath.Join(filepath.Dir(fPath), "carrier_headers.conf"), []byte(`LocalAddr="127.0.0.1:1252";
+DestAddr="10.0.0.172:80";
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PROXY_PASSWORD", "secret")
+	defer os.Unsetenv("PROXY_PASSWORD")
+
+	c, err := loadConfig(fPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth := c.Section("upstream.carrier").String("Auth", ""); auth != "user:secret" {
+		t.Errorf("Auth: got %q", auth)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"net"
+	"strings"
+)
+
+func checkPortList(value string) error {
+	_, err := tunnelclient.ParsePortList(strings.Split(value, ","))
+	return err
+}
+
+// checkDestList 逗号分隔的 CIDR, IP 或域名
+func checkDestList(value string) error {
+	_, _, err := parseDestList(strings.Split(value, ","))
+	return err
+}
+
+// parseDestList 含 / 或可解析为 IP 的为网段, 其他为域名
+func parseDestList(list []string) (nets tunnelclient.IPList, domains []string, err error) {
+	var cidrs []string
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case strings.Contains(s, "/") || net.ParseIP(s) != nil:
+			cidrs = append(cidrs, s)
+		default:
+			domains = append(domains, s)
+		}
+	}
+	nets, err = tunnelclient.ParseIPList(cidrs)
+	return
+}
+
+// destPolicy 监听的目标限制, 默认不限制
+func destPolicy(c *lineconfig.LineConfig, def listenerDef) *tunnelclient.DestPolicy {
+	p := &tunnelclient.DestPolicy{}
+	p.Ports, _ = tunnelclient.ParsePortList(listenerList(c, def, "AllowPort"))
+
+	blockPrivate := def.sec.Bool("BlockPrivate", c.Bool("BlockPrivate", false))
+	if blockPrivate {
+		p.Nets = append(p.Nets, tunnelclient.PrivateNets...)
+		p.Domains = append(p.Domains, "localhost")
+	}
+	nets, domains, _ := parseDestList(listenerList(c, def, "DenyDest"))
+	p.Nets = append(p.Nets, nets...)
+	p.Domains = append(p.Domains, domains...)
+	return p
+}
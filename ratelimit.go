@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidRate      = errors.New("should be bytes per second such as 512K or 2M, 0 for no limit")
+	ErrInvalidConnLimit = errors.New("should be a number of connections, 0 for no limit")
+
+	rateUnits = []struct {
+		suffix string
+		size   float64
+	}{
+		{"G", 1 << 30},
+		{"M", 1 << 20},
+		{"K", 1 << 10},
+	}
+)
+
+func checkRate(value string) error {
+	_, err := parseRate(value)
+	return err
+}
+
+// parseRate 解析每秒字节数, 可带 K, M, G 单位及可选的 B, 如 512K, 1.5MB
+func parseRate(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "B")
+	size := 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, size = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidRate
+	}
+	return int64(n * size), nil
+}
+
+// listenerRate 监听没有设置时使用顶层的值, 格式错误时不限速
+func listenerRate(c *lineconfig.LineConfig, def listenerDef, key string) int64 {
+	rate, _ := parseRate(listenerValue(c, def, key))
+	return rate
+}
+
+func checkConnLimit(value string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return ErrInvalidConnLimit
+	}
+	return nil
+}
+
+// listenerInt 监听没有设置时使用顶层的值, 格式错误时为 0
+func listenerInt(c *lineconfig.LineConfig, def listenerDef, key string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(listenerValue(c, def, key)))
+	return n
+}
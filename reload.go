@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	reloadMu sync.Mutex
+)
+
+// reload 重新加载配置, 校验失败时保留旧配置.
+// 新增, 删除监听以及修改 LocalAddr 和 Mode 需要重启.
+func reload(srv *tunnelclient.Server) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	newLc, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	applyGlobalRate(srv, newLc)
+	defs := listenerDefs(newLc)
+	names := map[string]bool{}
+	for _, def := range defs {
+		names[def.name] = true
+		tc := srv.Listener(def.name)
+		if tc == nil {
+			log.Printf("reload: new listener %s, restart to take effect\n", def.name)
+			continue
+		}
+
+		tc.Update(func(c *tunnelclient.TunnelHTTPClient) {
+			localAddr, mode := c.LocalAddr, c.Mode
+			applyListener(c, newLc, def)
+			if c.LocalAddr != localAddr || c.Mode != mode {
+				log.Printf("reload: listener %s changed to %s %s, restart to take effect\n", def.name, c.Mode, c.LocalAddr)
+			}
+			c.LocalAddr, c.Mode = localAddr, mode
+		})
+	}
+	for _, tc := range srv.Listeners() {
+		if !names[tc.Name] {
+			log.Printf("reload: listener %s removed, restart to take effect\n", tc.Name)
+		}
+	}
+
+	lc = newLc
+	return nil
+}
+
+func reloadOnSignal(srv *tunnelclient.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := reload(srv)
+		if err != nil {
+			log.Printf("reload config error, keep the old one: %s\n", err)
+			continue
+		}
+		log.Println("config reloaded")
+	}
+}
+
+// reloadOnChange 定时检查配置文件及其 include 的文件的修改时间
+func reloadOnChange(srv *tunnelclient.Server, interval time.Duration) {
+	modTime, _ := configModTime()
+	for range time.Tick(interval) {
+		t, err := configModTime()
+		if err != nil || t.Equal(modTime) {
+			continue
+		}
+		modTime = t
+
+		err = reload(srv)
+		if err != nil {
+			log.Printf("reload config error, keep the old one: %s\n", err)
+			continue
+		}
+		log.Println("config changed, reloaded")
+	}
+}
+
+// configModTime 返回配置文件中最新的修改时间
+func configModTime() (time.Time, error) {
+	reloadMu.Lock()
+	files := append([]string{configPath}, lc.Files()...)
+	reloadMu.Unlock()
+
+	var latest time.Time
+	for _, fPath := range files {
+		info, err := os.Stat(fPath)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.IsDir() {
+			return time.Time{}, errors.New(fPath + " is a directory")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,68 @@
+package tunnelclient
+
+import (
+	"net"
+	"strings"
+)
+
+type (
+	// IPList IP 网段的列表
+	IPList []*net.IPNet
+)
+
+// ParseIPList 解析 CIDR 或单个 IP 的列表, 如 192.168.1.0/24, ::1
+func ParseIPList(list []string) (IPList, error) {
+	var ipl IPList
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: s}
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipl = append(ipl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ipl = append(ipl, ipnet)
+	}
+	return ipl, nil
+}
+
+// Contains ip 是否在列表中
+func (ipl IPList) Contains(ip net.IP) bool {
+	for _, ipnet := range ipl {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetClientACL 设置允许和禁止的客户端 IP, 禁止优先, allow 为空时允许所有未被禁止的 IP.
+// unix socket 等没有 IP 的连接不受限制.
+func (thc *TunnelHTTPClient) SetClientACL(allow, deny IPList) {
+	thc.allowClients, thc.denyClients = allow, deny
+}
+
+// allowClient 检查客户端的 IP
+func (thc *TunnelHTTPClient) allowClient(conn net.Conn) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if thc.denyClients.Contains(addr.IP) {
+		return false
+	}
+	return len(thc.allowClients) == 0 || thc.allowClients.Contains(addr.IP)
+}
@@ -0,0 +1,123 @@
+package tunnelclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/ginuerzh/gosocks5"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type (
+	// socks5ServerSelector 按 thc 的用户进行 SOCKS5 认证
+	socks5ServerSelector struct {
+		thc *TunnelHTTPClient
+	}
+)
+
+const (
+	authRealm = "tcp_over_http_proxy"
+)
+
+// SetAuth 设置允许的用户名和密码, 为空时不需要认证.
+// HTTP 使用 Proxy-Authorization: Basic, SOCKS5 使用用户名/密码认证, 重定向模式不支持认证.
+func (thc *TunnelHTTPClient) SetAuth(users map[string]string) {
+	thc.users = users
+}
+
+// checkBasicAuth 检查 Proxy-Authorization 请求头, 返回认证通过的用户, 不需要认证时为空
+func (thc *TunnelHTTPClient) checkBasicAuth(header []byte) (user string, ok bool) {
+	if len(thc.users) == 0 {
+		return "", true
+	}
+	if header == nil {
+		return "", false
+	}
+
+	s := strings.SplitN(strings.TrimSpace(string(header)), " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[1]))
+	if err != nil {
+		return "", false
+	}
+
+	i := bytes.IndexByte(decoded, ':')
+	if i < 0 {
+		return "", false
+	}
+	user = string(decoded[:i])
+	if !thc.checkUser(user, string(decoded[i+1:])) {
+		return "", false
+	}
+	return user, true
+}
+
+func (thc *TunnelHTTPClient) checkUser(user, password string) bool {
+	p, ok := thc.users[user]
+	return ok && p == password
+}
+
+func writeAuthRequired(conn net.Conn, proto []byte) {
+	fmt.Fprintf(conn, "%s 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=%q\r\nContent-Length: 0\r\n\r\n", proto, authRealm)
+}
+
+// socks5Selector 有用户时要求用户名/密码认证, 认证通过的用户记录在 thc.user
+func (thc *TunnelHTTPClient) socks5Selector() gosocks5.Selector {
+	return &socks5ServerSelector{
+		thc: thc,
+	}
+}
+
+// Methods 只用于客户端
+func (sel *socks5ServerSelector) Methods() []uint8 {
+	return nil
+}
+
+// Select 客户端支持用户名/密码认证时选择该方式
+func (sel *socks5ServerSelector) Select(methods ...uint8) uint8 {
+	if len(sel.thc.users) == 0 {
+		return gosocks5.MethodNoAuth
+	}
+	for _, m := range methods {
+		if m == gosocks5.MethodUserPass {
+			return m
+		}
+	}
+	return gosocks5.MethodNoAcceptable
+}
+
+// OnSelected 进行 RFC1929 用户名/密码认证
+func (sel *socks5ServerSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	switch method {
+	case gosocks5.MethodNoAuth:
+		return conn, nil
+	case gosocks5.MethodUserPass:
+		req, err := gosocks5.ReadUserPassRequest(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !sel.thc.checkUser(req.Username, req.Password) {
+			gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Failure).Write(conn)
+			return nil, gosocks5.ErrAuthFailure
+		}
+		sel.thc.user = req.Username
+		err = gosocks5.NewUserPassResponse(gosocks5.UserPassVer, gosocks5.Succeeded).Write(conn)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return nil, gosocks5.ErrBadMethod
+}
+
+func parseProxyAuthorization(line []byte) []byte {
+	s := bytes.SplitN(line, []byte{':'}, 2)
+	if len(s) != 2 || http.CanonicalHeaderKey(string(bytes.TrimSpace(s[0]))) != "Proxy-Authorization" {
+		return nil
+	}
+	return bytes.TrimSpace(s[1])
+}
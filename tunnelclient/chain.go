@@ -0,0 +1,299 @@
+package tunnelclient
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/ginuerzh/gosocks5"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// HopType 上游代理的协议
+	HopType int
+
+	// Hop 上游链中的一个代理, 依次通过每个代理连接下一个代理, 最后一个代理连接目标
+	Hop struct {
+		Type    HopType
+		Addr    string
+		Headers HeadersFunc // 只用于 HTTP 和 HTTPS
+		// Username 和 Password 为 HTTP 的 Basic 认证, SOCKS5 的用户名/密码认证,
+		// SOCKS4a 只使用 Username 作为 userid
+		Username string
+		Password string
+		TLS      *tls.Config // 只用于 HTTPS, 为空时使用 Addr 的主机名校验证书
+	}
+
+	// socks5ClientSelector 有用户名时提供用户名/密码认证
+	socks5ClientSelector struct {
+		username string
+		password string
+	}
+
+	// SocksError 上游 SOCKS 代理拒绝了连接
+	SocksError struct {
+		Addr  string
+		Type  HopType
+		Reply byte
+	}
+)
+
+const (
+	HopHTTP HopType = iota
+	HopHTTPS
+	HopSOCKS5
+	HopSOCKS4a
+)
+
+const (
+	socks4Ver        = 4
+	socks4CmdConnect = 1
+	socks4Granted    = 0x5a
+)
+
+var (
+	hopTypeNames = map[HopType]string{
+		HopHTTP:    "http",
+		HopHTTPS:   "https",
+		HopSOCKS5:  "socks5",
+		HopSOCKS4a: "socks4a",
+	}
+
+	ErrSocks4Reply = errors.New("invalid socks4 reply")
+)
+
+// ParseHopType 解析 http, https, socks5 或 socks4a
+func ParseHopType(s string) (HopType, error) {
+	for t, name := range hopTypeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown upstream type: %s", s)
+}
+
+func (ht HopType) String() string {
+	if name, ok := hopTypeNames[ht]; ok {
+		return name
+	}
+	return fmt.Sprintf("HopType(%d)", int(ht))
+}
+
+func (se *SocksError) Error() string {
+	return fmt.Sprintf("%s connect through %s: reply %d", se.Type, se.Addr, se.Reply)
+}
+
+// SetChain 设置上游链, 为空时只有 DestAddr 一个 HTTP 代理
+func (thc *TunnelHTTPClient) SetChain(hops []Hop) {
+	thc.chain = hops
+}
+
+// hops 返回实际使用的上游链
+func (thc *TunnelHTTPClient) hops() []Hop {
+	if len(thc.chain) > 0 {
+		return thc.chain
+	}
+	return []Hop{{
+		Type:    HopHTTP,
+		Addr:    thc.DestAddr,
+		Headers: thc.headersFunc,
+	}}
+}
+
+// chainString 如 10.0.0.172:80 -> proxy.corp:443
+func (thc *TunnelHTTPClient) chainString() string {
+	hops := thc.hops()
+	addrs := make([]string, len(hops))
+	for k, hop := range hops {
+		addrs[k] = hop.Addr
+	}
+	return strings.Join(addrs, " -> ")
+}
+
+// connectChain 在已连接到第一个代理的 conn 上逐个握手, 建立到 host 的隧道, 返回最后一个代理的状态
+func (thc *TunnelHTTPClient) connectChain(conn net.Conn, host []byte) (tunnel net.Conn, status string, err error) {
+	hops := thc.hops()
+	tunnel = conn
+	for k, hop := range hops {
+		target := host
+		if k+1 < len(hops) {
+			target = []byte(hops[k+1].Addr)
+		}
+		tunnel, status, err = hop.connect(tunnel, target)
+		if err != nil {
+			return nil, status, err
+		}
+	}
+	return tunnel, status, nil
+}
+
+// connect 通过该代理连接 target
+func (hop *Hop) connect(conn net.Conn, target []byte) (net.Conn, string, error) {
+	switch hop.Type {
+	case HopHTTPS:
+		tlsConn := tls.Client(conn, hop.tlsConfig())
+		err := tlsConn.Handshake()
+		if err != nil {
+			return nil, "", err
+		}
+		return httpConnect(tlsConn, hop.Addr, target, hop.ProxyHeaders(target))
+	case HopSOCKS5:
+		return socks5Connect(conn, hop.Addr, string(target), &socks5ClientSelector{
+			username: hop.Username,
+			password: hop.Password,
+		})
+	case HopSOCKS4a:
+		return socks4aConnect(conn, hop.Addr, string(target), hop.Username)
+	}
+	return httpConnect(conn, hop.Addr, target, hop.ProxyHeaders(target))
+}
+
+// ProxyHeaders 发往该代理的自定义请求头, 以及 Basic 认证
+func (hop *Hop) ProxyHeaders(target []byte) string {
+	var headers string
+	if hop.Headers != nil {
+		headers = hop.Headers(target)
+	}
+	if hop.Username != "" {
+		headers += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(hop.Username+":"+hop.Password)) + "\r\n"
+	}
+	return headers
+}
+
+func (hop *Hop) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if hop.TLS != nil {
+		cfg = hop.TLS.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(hop.Addr)
+		if err != nil {
+			host = hop.Addr
+		}
+		cfg.ServerName = host
+	}
+	return cfg
+}
+
+func (sel *socks5ClientSelector) Methods() []uint8 {
+	if sel.username == "" {
+		return []uint8{gosocks5.MethodNoAuth}
+	}
+	return []uint8{gosocks5.MethodNoAuth, gosocks5.MethodUserPass}
+}
+
+func (sel *socks5ClientSelector) Select(methods ...uint8) uint8 {
+	return gosocks5.MethodNoAuth
+}
+
+// OnSelected 代理选择了用户名/密码认证时发送 RFC1929 请求
+func (sel *socks5ClientSelector) OnSelected(method uint8, conn net.Conn) (net.Conn, error) {
+	switch method {
+	case gosocks5.MethodNoAuth:
+		return conn, nil
+	case gosocks5.MethodUserPass:
+		if sel.username == "" {
+			return nil, gosocks5.ErrBadMethod
+		}
+		err := gosocks5.NewUserPassRequest(gosocks5.UserPassVer, sel.username, sel.password).Write(conn)
+		if err != nil {
+			return nil, err
+		}
+		res, err := gosocks5.ReadUserPassResponse(conn)
+		if err != nil {
+			return nil, err
+		}
+		if res.Status != gosocks5.Succeeded {
+			return nil, gosocks5.ErrAuthFailure
+		}
+		return conn, nil
+	}
+	return nil, gosocks5.ErrBadMethod
+}
+
+// socks5Connect SOCKS5 CONNECT, 认证方式由 selector 决定
+func socks5Connect(conn net.Conn, addr, target string, selector gosocks5.Selector) (net.Conn, string, error) {
+	dest, err := gosocks5.NewAddr(target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	c := gosocks5.ClientConn(conn, selector)
+	err = c.Handleshake()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = gosocks5.NewRequest(gosocks5.CmdConnect, dest).Write(c)
+	if err != nil {
+		return nil, "", err
+	}
+	rep, err := gosocks5.ReadReply(c)
+	if err != nil {
+		return nil, "", err
+	}
+	status := fmt.Sprintf("socks5 reply %d", rep.Rep)
+	if rep.Rep != gosocks5.Succeeded {
+		return nil, status, &SocksError{
+			Addr:  addr,
+			Type:  HopSOCKS5,
+			Reply: rep.Rep,
+		}
+	}
+	return c, status, nil
+}
+
+// socks4aConnect 由代理解析域名的 SOCKS4a CONNECT
+func socks4aConnect(conn net.Conn, addr, target, userid string) (net.Conn, string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req := []byte{socks4Ver, socks4CmdConnect, byte(port >> 8), byte(port)}
+	ip := net.ParseIP(host).To4()
+	if ip != nil {
+		req = append(req, ip...)
+		req = append(req, userid...)
+		req = append(req, 0)
+	} else {
+		// 0.0.0.x 表示之后带有域名
+		req = append(req, 0, 0, 0, 1)
+		req = append(req, userid...)
+		req = append(req, 0)
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rep := make([]byte, 8)
+	_, err = io.ReadFull(conn, rep)
+	if err != nil {
+		return nil, "", err
+	}
+	if rep[0] != 0 {
+		return nil, "", ErrSocks4Reply
+	}
+	status := fmt.Sprintf("socks4a reply %d", rep[1])
+	if rep[1] != socks4Granted {
+		return nil, status, &SocksError{
+			Addr:  addr,
+			Type:  HopSOCKS4a,
+			Reply: rep[1],
+		}
+	}
+	return conn, status, nil
+}
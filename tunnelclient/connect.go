@@ -0,0 +1,152 @@
+package tunnelclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+type (
+	// ConnectError 上游代理拒绝了 CONNECT
+	ConnectError struct {
+		Addr       string
+		StatusLine string
+		Headers    [][]byte // 响应头, 不含 \r\n
+		Body       []byte   // 有 Content-Length 时的消息体
+	}
+
+	// ProbeResult 一次 CONNECT 探测的结果
+	ProbeResult struct {
+		Upstream    string
+		Target      string
+		StatusLine  string
+		DialTime    time.Duration // 连接第一个上游代理的耗时
+		ConnectTime time.Duration // 逐个握手直到连上 target 的耗时
+	}
+
+	// bufferedConn 先读取握手时多读的数据
+	bufferedConn struct {
+		net.Conn
+		r *bufio.Reader
+	}
+)
+
+var (
+	// dialTimeout 连接上游以及逐个握手的超时
+	dialTimeout = 10 * time.Second
+)
+
+const (
+	// maxErrorBody 上游错误响应的消息体的最大长度
+	maxErrorBody = 64 << 10
+)
+
+func (ce *ConnectError) Error() string {
+	return fmt.Sprintf("CONNECT through %s: %s", ce.Addr, ce.StatusLine)
+}
+
+// StatusCode 响应的状态码, 格式错误时返回 0
+func (ce *ConnectError) StatusCode() int {
+	return (&httpHead{line: []byte(ce.StatusLine)}).statusCode()
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// dialTunnel 连接上游链的第一个代理, 逐个握手后建立到 host 的隧道
+func (thc *TunnelHTTPClient) dialTunnel(host []byte) (net.Conn, error) {
+	hops := thc.hops()
+	conn, err := thc.dial(hops[0].Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// 上游接受连接后不回复时不会一直等待, 超时返回 504 或 TTL expired
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	tunnel, _, err := thc.connectChain(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// httpConnect 在 conn 上发送 CONNECT 请求, 并读取响应头
+func httpConnect(conn net.Conn, addr string, host []byte, headers string) (tunnel net.Conn, statusLine string, err error) {
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.0\r\n%s\r\n", host, headers)
+	if err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	head, err := readHead(r)
+	if err != nil {
+		return
+	}
+	statusLine = string(head.line)
+
+	fields := bytes.Fields(head.line)
+	if len(fields) < 2 || len(fields[1]) != 3 {
+		err = fmt.Errorf("unknown first line from %s: %q", addr, head.line)
+		return
+	}
+
+	if fields[1][0] != '2' {
+		err = &ConnectError{
+			Addr:       addr,
+			StatusLine: statusLine,
+			Headers:    head.headers,
+			Body:       readErrorBody(r, head),
+		}
+		return
+	}
+
+	tunnel = &bufferedConn{
+		Conn: conn,
+		r:    r,
+	}
+	return
+}
+
+// readErrorBody 读取错误响应有 Content-Length 的消息体, 用于返回给客户端
+func readErrorBody(r *bufio.Reader, head *httpHead) []byte {
+	length, err := head.responseBodyLength([]byte(http.MethodConnect))
+	if err != nil || length <= 0 || length > maxErrorBody {
+		return nil
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// Probe 通过上游代理 CONNECT 到 target, 返回状态和耗时, 用于检测上游是否可用.
+// 有多个代理时, StatusLine 为最后一个代理的状态.
+func (thc *TunnelHTTPClient) Probe(target string) (*ProbeResult, error) {
+	res := &ProbeResult{
+		Upstream: thc.chainString(),
+		Target:   target,
+	}
+
+	start := time.Now()
+	conn, err := thc.dial(thc.hops()[0].Addr)
+	res.DialTime = time.Since(start)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	start = time.Now()
+	_, res.StatusLine, err = thc.connectChain(conn, []byte(target))
+	res.ConnectTime = time.Since(start)
+	return res, err
+}
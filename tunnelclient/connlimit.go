@@ -0,0 +1,137 @@
+package tunnelclient
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/ginuerzh/gosocks5"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// connLimits 同时处理的连接数, 总数和每个客户端 IP 分别限制, 0 为不限制
+	connLimits struct {
+		mu    sync.Mutex
+		max   int
+		perIP int
+		total int
+		ip    map[string]int
+	}
+)
+
+const (
+	// rejectTimeout 拒绝连接时回复的超时
+	rejectTimeout = 100 * time.Millisecond
+
+	serviceUnavailable = "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// SetConnLimit 设置该监听同时处理的最大连接数和每个客户端 IP 的最大连接数, 0 为不限制.
+// 超过时立即拒绝, HTTP 返回 503, SOCKS5 回复 general failure.
+func (thc *TunnelHTTPClient) SetConnLimit(max, perIP int) {
+	cl := &thc.limits.conns
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.max, cl.perIP = max, perIP
+}
+
+// acquire 占用一个连接, 超过限制时返回 false
+func (cl *connLimits) acquire(ip string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.max > 0 && cl.total >= cl.max {
+		return false
+	}
+	if ip != "" && cl.perIP > 0 && cl.ip[ip] >= cl.perIP {
+		return false
+	}
+	cl.total++
+	if ip != "" {
+		if cl.ip == nil {
+			cl.ip = map[string]int{}
+		}
+		cl.ip[ip]++
+	}
+	return true
+}
+
+func (cl *connLimits) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.total--
+	if ip == "" {
+		return
+	}
+	cl.ip[ip]--
+	if cl.ip[ip] <= 0 {
+		delete(cl.ip, ip)
+	}
+}
+
+// acceptDelay 临时错误时的等待时间, 从 5ms 开始加倍, 最多 1s
+func acceptDelay(last time.Duration) time.Duration {
+	if last == 0 {
+		return minAcceptDelay
+	}
+	last *= 2
+	if last > maxAcceptDelay {
+		last = maxAcceptDelay
+	}
+	return last
+}
+
+// reject 关闭超过限制的连接, 所有读写在 rejectTimeout 内完成.
+// HTTP 不读取请求, 直接返回固定的 503; SOCKS5 协商认证方法后对请求回复 general failure;
+// mixed 按首个字节区分.
+func (thc *TunnelHTTPClient) reject(conn net.Conn, st ServMode) {
+	defer conn.Close()
+	thc.metrics.connRejected()
+	log.Printf("%s: too many connections, reject %s\n", thc.Name, conn.RemoteAddr())
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	switch st {
+	case SERV_HTTP_PROXY:
+		io.WriteString(conn, serviceUnavailable)
+	case SERV_SOCKS5, SERV_MIXED:
+		r := bufio.NewReader(conn)
+		if st == SERV_MIXED {
+			first, err := r.Peek(1)
+			if err != nil {
+				return
+			}
+			if first[0] != gosocks5.Ver5 {
+				io.WriteString(conn, serviceUnavailable)
+				return
+			}
+		}
+		rejectSocks5(conn, r)
+	}
+}
+
+// rejectSocks5 客户端支持无认证时协商后回复 general failure, 否则回复没有可用的方法
+func rejectSocks5(conn net.Conn, r *bufio.Reader) {
+	methods, err := gosocks5.ReadMethods(r)
+	if err != nil {
+		return
+	}
+	if bytes.IndexByte(methods, gosocks5.MethodNoAuth) < 0 {
+		gosocks5.WriteMethod(gosocks5.MethodNoAcceptable, conn)
+		return
+	}
+	err = gosocks5.WriteMethod(gosocks5.MethodNoAuth, conn)
+	if err != nil {
+		return
+	}
+	// 读取请求后再回复, 避免关闭时未读的数据导致 RST, 客户端收不到回复
+	_, err = gosocks5.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	gosocks5.NewReply(gosocks5.Failure, nil).Write(conn)
+}
@@ -0,0 +1,70 @@
+package tunnelclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+type (
+	// Dialer 建立到上游和中继的连接, 可用于绑定源地址, 网卡, 自定义解析或测试
+	Dialer interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}
+
+	// BindOptions 出站连接的本地地址和套接字选项, 零值表示不设置
+	BindOptions struct {
+		Addr      string // 源 IP
+		Interface string // SO_BINDTODEVICE, 仅 linux
+		Mark      int    // SO_MARK, 仅 linux
+	}
+)
+
+var (
+	ErrInvalidBindAddr = errors.New("invalid bind address")
+	ErrBindUnsupported = errors.New("binding to an interface or setting a fwmark is only supported on linux")
+
+	// DefaultDialer 没有设置 Dialer 时使用
+	DefaultDialer Dialer = &net.Dialer{
+		KeepAlive: 30 * time.Second,
+	}
+)
+
+// SetDialer 设置连接上游和中继使用的 Dialer, 为 nil 时使用 DefaultDialer
+func (thc *TunnelHTTPClient) SetDialer(d Dialer) {
+	thc.dialer = d
+}
+
+// dial 通过 Dialer 连接 addr, 超时为 dialTimeout
+func (thc *TunnelHTTPClient) dial(addr string) (net.Conn, error) {
+	d := thc.dialer
+	if d == nil {
+		d = DefaultDialer
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// NewBindDialer 返回按 opt 绑定的 Dialer
+func NewBindDialer(opt BindOptions) (Dialer, error) {
+	d := &net.Dialer{
+		KeepAlive: 30 * time.Second,
+	}
+	if opt.Addr != "" {
+		ip := net.ParseIP(opt.Addr)
+		if ip == nil {
+			return nil, ErrInvalidBindAddr
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if opt.Interface != "" || opt.Mark != 0 {
+		control, err := bindControl(opt.Interface, opt.Mark)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
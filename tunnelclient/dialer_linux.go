@@ -0,0 +1,27 @@
+package tunnelclient
+
+import (
+	"syscall"
+)
+
+// bindControl 在连接前设置 SO_BINDTODEVICE 和 SO_MARK, 需要 CAP_NET_RAW 或 CAP_NET_ADMIN
+func bindControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if iface != "" {
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+				if sockErr != nil {
+					return
+				}
+			}
+			if mark != 0 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,74 @@
+package tunnelclient_test
+
+import (
+	"context"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// bindListener 需要 root 权限, 返回本地的监听
+func bindListener(t *testing.T) net.Listener {
+	if os.Geteuid() != 0 {
+		t.Skip("SO_BINDTODEVICE and SO_MARK need root")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestBindInterface(t *testing.T) {
+	l := bindListener(t)
+	defer l.Close()
+
+	d, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Interface: "lo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 不存在的网卡在连接时失败
+	d, err = tunnelclient.NewBindDialer(tunnelclient.BindOptions{Interface: "nosuchif0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("expected error for a missing interface")
+	}
+}
+
+func TestBindMark(t *testing.T) {
+	l := bindListener(t)
+	defer l.Close()
+
+	d, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Mark: 0x100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	raw.Control(func(fd uintptr) {
+		mark, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err != nil || mark != 0x100 {
+		t.Errorf("SO_MARK: got %#x %v, want 0x100", mark, err)
+	}
+}
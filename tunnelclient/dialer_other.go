@@ -0,0 +1,11 @@
+// +build !linux
+
+package tunnelclient
+
+import (
+	"syscall"
+)
+
+func bindControl(iface string, mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrBindUnsupported
+}
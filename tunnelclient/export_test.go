@@ -0,0 +1,14 @@
+package tunnelclient
+
+import (
+	"time"
+)
+
+// SetDialTimeout 修改连接和握手的超时, 返回恢复原值的函数, 只用于测试
+func SetDialTimeout(d time.Duration) (restore func()) {
+	old := dialTimeout
+	dialTimeout = d
+	return func() {
+		dialTimeout = old
+	}
+}
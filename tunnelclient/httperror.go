@@ -0,0 +1,90 @@
+package tunnelclient
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+)
+
+type (
+	// ErrorPage 错误页面模板的数据
+	ErrorPage struct {
+		Code     int
+		Status   string // 如 Bad Gateway
+		Target   string // 客户端请求的目标
+		Upstream string
+		Error    string
+	}
+)
+
+// SetErrorPage 设置返回给 HTTP 客户端的错误页面模板, 数据为 ErrorPage, 为 nil 时返回纯文本
+func (thc *TunnelHTTPClient) SetErrorPage(tmpl *template.Template) {
+	thc.errorPage = tmpl
+}
+
+// errorResponse 连接 upstream 失败时返回给 HTTP 客户端的完整响应, 之后应关闭连接.
+// 上游拒绝时返回其状态, 有消息体时连同头部原样返回; 超时返回 504, 其他错误返回 502.
+func (thc *TunnelHTTPClient) errorResponse(host []byte, upstream string, err error) string {
+	page := &ErrorPage{
+		Code:     http.StatusBadGateway,
+		Target:   string(host),
+		Upstream: upstream,
+		Error:    err.Error(),
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		page.Code = http.StatusGatewayTimeout
+	}
+	statusLine := fmt.Sprintf("HTTP/1.1 %d %s", page.Code, http.StatusText(page.Code))
+
+	var (
+		headers [][]byte
+		body    []byte
+	)
+	if ce, ok := err.(*ConnectError); ok && ce.StatusCode() != 0 {
+		page.Code, statusLine, body = ce.StatusCode(), ce.StatusLine, ce.Body
+		for _, h := range ce.Headers {
+			switch headerKey(h) {
+			case "Content-Length", "Transfer-Encoding", "Connection", "Keep-Alive", "Proxy-Connection":
+				continue
+			case "Proxy-Authenticate":
+			default:
+				if len(body) == 0 { // 使用自己的页面, 只保留认证的头部
+					continue
+				}
+			}
+			headers = append(headers, h)
+		}
+	}
+
+	if len(body) == 0 {
+		page.Status = http.StatusText(page.Code)
+		var contentType string
+		body, contentType = thc.errorBody(page)
+		headers = append(headers, []byte("Content-Type: "+contentType))
+	}
+
+	var b bytes.Buffer
+	b.WriteString(statusLine)
+	b.WriteString("\r\n")
+	for _, h := range headers {
+		b.Write(h)
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\nConnection: close\r\n\r\n", len(body))
+	b.Write(body)
+	return b.String()
+}
+
+// errorBody 按模板生成错误页面, 没有模板或执行出错时为纯文本
+func (thc *TunnelHTTPClient) errorBody(page *ErrorPage) (body []byte, contentType string) {
+	if thc.errorPage != nil {
+		var b bytes.Buffer
+		err := thc.errorPage.Execute(&b, page)
+		if err == nil {
+			return b.Bytes(), "text/html; charset=utf-8"
+		}
+	}
+	return []byte(fmt.Sprintf("%d %s: %s\n", page.Code, page.Status, page.Error)), "text/plain; charset=utf-8"
+}
@@ -0,0 +1,259 @@
+package tunnelclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type (
+	// httpHead HTTP/1.x 消息的起始行和头部, 均不含 \r\n
+	httpHead struct {
+		line    []byte
+		headers [][]byte
+	}
+)
+
+const (
+	// maxHeadSize 起始行和头部的最大长度
+	maxHeadSize   = 64 << 10
+	maxMethodSize = 16
+	methodTimeout = time.Second
+
+	// 消息体的长度, 非负数为 Content-Length
+	bodyChunked  int64 = -1
+	bodyUntilEOF int64 = -2
+)
+
+var (
+	ErrHeadTooLarge    = errors.New("http head too large")
+	ErrInvalidChunk    = errors.New("invalid chunk size")
+	ErrInvalidBodySize = errors.New("invalid Content-Length")
+)
+
+// looksLikeHTTP 数据是否以 HTTP 方法开头, 如 "GET ", 用于区分 TLS 等其他协议.
+// 方法可能分多次到达, 逐个字节等待, 直到空格或 maxMethodSize, 最多等待 methodTimeout.
+func looksLikeHTTP(conn net.Conn, r *bufio.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(methodTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for n := 1; n <= maxMethodSize+1; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return false
+		}
+		c := b[n-1]
+		if c == ' ' {
+			return n > 1
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return false
+}
+
+// readLine 读取一行, 去掉结尾的 \r\n, 返回的数据不会被之后的读取覆盖
+func readLine(r *bufio.Reader, limit *int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		*limit -= len(b)
+		if *limit < 0 {
+			return nil, ErrHeadTooLarge
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// readHead 读取起始行和头部, 直到空行
+func readHead(r *bufio.Reader) (*httpHead, error) {
+	limit := maxHeadSize
+	line, err := readLine(r, &limit)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpHead{
+		line: line,
+	}
+	for {
+		line, err = readLine(r, &limit)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(line) == 0 {
+			return h, nil
+		}
+		h.headers = append(h.headers, line)
+	}
+}
+
+// headerKey 头部的名称, 规范格式, 没有冒号时返回空
+func headerKey(line []byte) string {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return ""
+	}
+	return http.CanonicalHeaderKey(string(bytes.TrimSpace(line[:i])))
+}
+
+// get 返回第一个名为 key 的头部的值, key 为规范格式, 如 Content-Length
+func (h *httpHead) get(key string) []byte {
+	for _, line := range h.headers {
+		if headerKey(line) == key {
+			return bytes.TrimSpace(line[bytes.IndexByte(line, ':')+1:])
+		}
+	}
+	return nil
+}
+
+// hasToken 头部 key 的逗号分隔的值中是否包含 token, 忽略大小写
+func (h *httpHead) hasToken(key, token string) bool {
+	for _, v := range bytes.Split(h.get(key), []byte{','}) {
+		if bytes.EqualFold(bytes.TrimSpace(v), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusCode 响应的状态码, 格式错误时返回 0
+func (h *httpHead) statusCode() int {
+	fields := bytes.Fields(h.line)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(string(fields[1]))
+	return code
+}
+
+// writeTo 写入 line 和头部, extra 为额外的头部, 放在原有头部之前
+func (h *httpHead) writeTo(w io.Writer, line []byte, extra string) error {
+	var b bytes.Buffer
+	b.Write(line)
+	b.WriteString("\r\n")
+	b.WriteString(extra)
+	for _, header := range h.headers {
+		b.Write(header)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// contentLength 解析 Content-Length, 没有时返回 def
+func (h *httpHead) contentLength(def int64) (int64, error) {
+	if h.hasToken("Transfer-Encoding", "chunked") {
+		return bodyChunked, nil
+	}
+	cl := h.get("Content-Length")
+	if cl == nil {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(string(cl), 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidBodySize
+	}
+	return n, nil
+}
+
+// requestBodyLength 请求没有 Content-Length 和 chunked 时没有消息体
+func (h *httpHead) requestBodyLength() (int64, error) {
+	return h.contentLength(0)
+}
+
+// responseBodyLength HEAD 请求的响应, 1xx, 204 和 304 没有消息体,
+// 没有 Content-Length 和 chunked 时读到连接关闭
+func (h *httpHead) responseBodyLength(method []byte) (int64, error) {
+	code := h.statusCode()
+	if bytes.Equal(method, []byte(http.MethodHead)) || (code >= 100 && code < 200) ||
+		code == http.StatusNoContent || code == http.StatusNotModified {
+		return 0, nil
+	}
+	return h.contentLength(bodyUntilEOF)
+}
+
+// copyBody 按 length 复制消息体
+func copyBody(dst io.Writer, r *bufio.Reader, length int64) error {
+	switch {
+	case length >= 0:
+		_, err := io.CopyN(dst, r, length)
+		return err
+	case length == bodyChunked:
+		return copyChunked(dst, r)
+	}
+	_, err := io.Copy(dst, r)
+	return err
+}
+
+// copyChunked 原样复制 chunked 消息体, 包括结尾的 trailer
+func copyChunked(dst io.Writer, r *bufio.Reader) error {
+	for {
+		limit := maxHeadSize
+		line, err := readLine(r, &limit)
+		if err != nil {
+			return err
+		}
+		sizeStr := line
+		if i := bytes.IndexByte(sizeStr, ';'); i >= 0 {
+			sizeStr = sizeStr[:i]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(sizeStr)), 16, 64)
+		if err != nil || size < 0 {
+			return ErrInvalidChunk
+		}
+		_, err = dst.Write(append(line, '\r', '\n'))
+		if err != nil {
+			return err
+		}
+
+		if size == 0 { // trailer, 直到空行
+			for {
+				line, err = readLine(r, &limit)
+				if err != nil {
+					return err
+				}
+				_, err = dst.Write(append(line, '\r', '\n'))
+				if err != nil || len(line) == 0 {
+					return err
+				}
+			}
+		}
+
+		// 数据和结尾的 \r\n
+		_, err = io.CopyN(dst, r, size)
+		if err != nil {
+			return err
+		}
+		line, err = readLine(r, &limit)
+		if err != nil {
+			return err
+		}
+		if len(line) != 0 {
+			return ErrInvalidChunk
+		}
+		_, err = dst.Write([]byte("\r\n"))
+		if err != nil {
+			return err
+		}
+	}
+}
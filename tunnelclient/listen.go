@@ -0,0 +1,241 @@
+package tunnelclient
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// unixListener 关闭时删除 socket 文件
+	unixListener struct {
+		net.Listener
+		path string
+		once sync.Once
+	}
+
+	// systemdFiles 通过 systemd socket activation 传入的监听
+	systemdFiles struct {
+		once  sync.Once
+		mu    sync.Mutex
+		files []*os.File
+		names []string
+		used  []bool
+	}
+)
+
+const (
+	// UnixPrefix LocalAddr 为 unix:/path/to.sock 时监听 unix domain socket
+	UnixPrefix = "unix:"
+	// SystemdPrefix LocalAddr 为 systemd: 或 systemd:name 时使用 systemd 传入的监听,
+	// name 对应 FileDescriptorName, 为空时按顺序使用
+	SystemdPrefix = "systemd:"
+
+	// systemd 传入的第一个 fd
+	listenFdsStart = 3
+)
+
+var (
+	ErrNoSystemdListener = errors.New("no socket passed by systemd")
+	ErrNotSocket         = errors.New("file exists and is not a socket")
+	ErrSocketInUse       = errors.New("socket is in use by another process")
+
+	systemd systemdFiles
+)
+
+// CheckListenAddr 检查 LocalAddr 的格式
+func CheckListenAddr(addr string) error {
+	addr = strings.TrimSpace(addr)
+	switch {
+	case strings.HasPrefix(addr, UnixPrefix):
+		if addr == UnixPrefix {
+			return errors.New("missing unix socket path")
+		}
+		return nil
+	case strings.HasPrefix(addr, SystemdPrefix):
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	return err
+}
+
+// Listen 按 LocalAddr 创建监听, 供 Serve 使用
+func (thc *TunnelHTTPClient) Listen() (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(thc.LocalAddr, UnixPrefix):
+		return thc.listenUnix(strings.TrimPrefix(thc.LocalAddr, UnixPrefix))
+	case strings.HasPrefix(thc.LocalAddr, SystemdPrefix):
+		return systemd.listener(strings.TrimPrefix(thc.LocalAddr, SystemdPrefix))
+	}
+	return net.Listen("tcp", thc.LocalAddr)
+}
+
+// listenUnix 监听 unix domain socket, 并设置权限和所有者.
+// socket 先在只有自己可以访问的临时目录中创建, 设置完成后再移动到 path, 替换残留的 socket 文件,
+// 在此之前其他用户无法连接.
+func (thc *TunnelHTTPClient) listenUnix(path string) (net.Listener, error) {
+	err := checkStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if thc.SocketMode != 0 {
+		err = os.Chmod(tmp, thc.SocketMode)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if thc.SocketOwner != "" {
+		uid, gid, err := lookupOwner(thc.SocketOwner)
+		if err == nil {
+			err = os.Chown(tmp, uid, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("chown %s: %s", path, err)
+		}
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{
+		Listener: l,
+		path:     path,
+	}, nil
+}
+
+// checkStaleSocket 检查 path 是否为残留的 socket 文件,
+// 不是 socket 或仍有服务在监听时返回错误
+func checkStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: %s", path, ErrNotSocket)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil
+	}
+	conn.Close()
+	return fmt.Errorf("%s: %s", path, ErrSocketInUse)
+}
+
+// Close 关闭监听并删除 socket 文件
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+	return err
+}
+
+// lookupOwner 解析 user, user:group 或 :group, 未指定的部分返回 -1
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	s := strings.SplitN(owner, ":", 2)
+	if s[0] != "" {
+		u, err := user.Lookup(s[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(s) == 2 && s[1] != "" {
+		g, err := user.LookupGroup(s[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return
+}
+
+// init 读取 LISTEN_PID, LISTEN_FDS 和 LISTEN_FDNAMES, 之后清除这些环境变量
+func (sf *systemdFiles) init() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for k := 0; k < n; k++ {
+		name := ""
+		if k < len(names) {
+			name = names[k]
+		}
+		sf.files = append(sf.files, os.NewFile(uintptr(listenFdsStart+k), name))
+		sf.names = append(sf.names, name)
+	}
+	sf.used = make([]bool, n)
+}
+
+// listener 返回名为 name 的未使用的监听, name 为空时返回第一个未使用的监听
+func (sf *systemdFiles) listener(name string) (net.Listener, error) {
+	sf.once.Do(sf.init)
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	for k, f := range sf.files {
+		if sf.used[k] || (name != "" && sf.names[k] != name) {
+			continue
+		}
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		sf.used[k] = true
+		f.Close()
+		return l, nil
+	}
+	if name != "" {
+		return nil, fmt.Errorf("%s: %s", ErrNoSystemdListener, name)
+	}
+	return nil, ErrNoSystemdListener
+}
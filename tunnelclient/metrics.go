@@ -0,0 +1,78 @@
+package tunnelclient
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+type (
+	// Metrics 连接和流量统计, 可由多个监听共享
+	Metrics struct {
+		Accepted  int64 // 接受的连接数
+		Active    int64 // 当前的连接数
+		Failed    int64 // 连接上游失败的次数
+		Rejected  int64 // 超过连接数限制而拒绝的连接数
+		BytesUp   int64 // 本地主机发送的字节数
+		BytesDown int64 // 发送给本地主机的字节数
+	}
+
+	// countConn 统计经过的字节数
+	countConn struct {
+		net.Conn
+		m *Metrics
+	}
+)
+
+// Snapshot 返回当前统计的副本
+func (m *Metrics) Snapshot() Metrics {
+	return Metrics{
+		Accepted:  atomic.LoadInt64(&m.Accepted),
+		Active:    atomic.LoadInt64(&m.Active),
+		Failed:    atomic.LoadInt64(&m.Failed),
+		Rejected:  atomic.LoadInt64(&m.Rejected),
+		BytesUp:   atomic.LoadInt64(&m.BytesUp),
+		BytesDown: atomic.LoadInt64(&m.BytesDown),
+	}
+}
+
+func (m Metrics) String() string {
+	return fmt.Sprintf("accepted: %d, active: %d, failed: %d, rejected: %d, up: %d bytes, down: %d bytes",
+		m.Accepted, m.Active, m.Failed, m.Rejected, m.BytesUp, m.BytesDown)
+}
+
+func (m *Metrics) connOpened() {
+	atomic.AddInt64(&m.Accepted, 1)
+	atomic.AddInt64(&m.Active, 1)
+}
+
+func (m *Metrics) connClosed() {
+	atomic.AddInt64(&m.Active, -1)
+}
+
+func (m *Metrics) connRejected() {
+	atomic.AddInt64(&m.Rejected, 1)
+}
+
+func (m *Metrics) upstreamFailed() {
+	atomic.AddInt64(&m.Failed, 1)
+}
+
+func (m *Metrics) wrap(conn net.Conn) net.Conn {
+	return &countConn{
+		Conn: conn,
+		m:    m,
+	}
+}
+
+func (cc *countConn) Read(b []byte) (n int, err error) {
+	n, err = cc.Conn.Read(b)
+	atomic.AddInt64(&cc.m.BytesUp, int64(n))
+	return
+}
+
+func (cc *countConn) Write(b []byte) (n int, err error) {
+	n, err = cc.Conn.Write(b)
+	atomic.AddInt64(&cc.m.BytesDown, int64(n))
+	return
+}
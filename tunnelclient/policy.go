@@ -0,0 +1,122 @@
+package tunnelclient
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// PortRange 端口范围, 包括两端
+	PortRange struct {
+		Min, Max int
+	}
+
+	// DestPolicy 限制 HTTP 和 SOCKS5 客户端可以连接的目标.
+	// 目标为域名时不会在本地解析, 只按 Domains 检查.
+	DestPolicy struct {
+		Ports   []PortRange // 允许的端口, 为空时允许所有端口
+		Nets    IPList      // 禁止的 IP
+		Domains []string    // 禁止的域名, 包括其子域名
+	}
+)
+
+var (
+	ErrDestNotAllowed = errors.New("destination not allowed")
+
+	// PrivateNets 回环, 链路本地和私有网段
+	PrivateNets, _ = ParseIPList([]string{
+		"127.0.0.0/8", "::1/128",
+		"169.254.0.0/16", "fe80::/10",
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+		"0.0.0.0/32", "::/128",
+	})
+)
+
+// ParsePortList 解析端口和端口范围, 如 80, 8000-8100, * 为所有端口, 返回 nil
+func ParsePortList(list []string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		switch s {
+		case "":
+			continue
+		case "*":
+			return nil, nil
+		}
+		min, max := s, s
+		if i := strings.IndexByte(s, '-'); i >= 0 {
+			min, max = s[:i], s[i+1:]
+		}
+		pr := PortRange{}
+		var err1, err2 error
+		pr.Min, err1 = strconv.Atoi(strings.TrimSpace(min))
+		pr.Max, err2 = strconv.Atoi(strings.TrimSpace(max))
+		if err1 != nil || err2 != nil || pr.Min < 1 || pr.Max > 65535 || pr.Min > pr.Max {
+			return nil, errors.New("invalid port: " + s)
+		}
+		ports = append(ports, pr)
+	}
+	return ports, nil
+}
+
+// SetDestPolicy 设置目标的限制, 为 nil 时不限制
+func (thc *TunnelHTTPClient) SetDestPolicy(p *DestPolicy) {
+	thc.destPolicy = p
+}
+
+// Check 检查 host:port, 不允许时返回 ErrDestNotAllowed
+func (p *DestPolicy) Check(hostport string) error {
+	if p == nil {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	if !p.allowPort(port) {
+		return ErrDestNotAllowed
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if p.Nets.Contains(ip) {
+			return ErrDestNotAllowed
+		}
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range p.Domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return ErrDestNotAllowed
+		}
+	}
+	return nil
+}
+
+func (p *DestPolicy) allowPort(port int) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, pr := range p.Ports {
+		if port >= pr.Min && port <= pr.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDest 检查目标, 不允许时记录日志
+func (thc *TunnelHTTPClient) checkDest(conn net.Conn, host []byte) error {
+	err := thc.destPolicy.Check(string(host))
+	if err != nil {
+		log.Printf("%s: %s from %s: %s\n", thc.Name, host, conn.RemoteAddr(), err)
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+package tunnelclient
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	// RateLimiter 令牌桶限速, 单位为字节/秒, 0 为不限速, 可在运行时修改.
+	// 桶的容量为一秒的流量.
+	RateLimiter struct {
+		mu     sync.Mutex
+		rate   int64
+		tokens float64
+		last   time.Time
+	}
+
+	// bandwidth 上传和下载分别限速
+	bandwidth struct {
+		up   RateLimiter
+		down RateLimiter
+	}
+
+	// limiterGroup 按用户或客户端 IP 分别限速, 没有连接时删除
+	limiterGroup struct {
+		mu   sync.Mutex
+		rate int64
+		m    map[string]*groupEntry
+	}
+
+	groupEntry struct {
+		bandwidth
+		refs int
+	}
+
+	// limits 一个监听的限速和连接数限制, 由该监听的所有连接共享
+	limits struct {
+		total bandwidth
+		user  limiterGroup
+		ip    limiterGroup
+		conns connLimits
+	}
+
+	// limitConn 读取为上传, 写入为下载
+	limitConn struct {
+		net.Conn
+		up      []*RateLimiter
+		down    []*RateLimiter
+		release []func()
+		once    sync.Once
+	}
+)
+
+// SetRate 修改速率, 立即对使用该限速的连接生效
+func (rl *RateLimiter) SetRate(rate int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate = rate
+}
+
+// Rate 返回当前的速率
+func (rl *RateLimiter) Rate() int64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.rate
+}
+
+// wait 取出 n 个令牌, 不够时等待. 允许透支, 之后的调用等待补足.
+func (rl *RateLimiter) wait(n int) {
+	rl.mu.Lock()
+	if rl.rate <= 0 {
+		rl.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	rate := float64(rl.rate)
+	if rl.last.IsZero() {
+		rl.tokens = rate
+	} else {
+		rl.tokens += now.Sub(rl.last).Seconds() * rate
+		if rl.tokens > rate {
+			rl.tokens = rate
+		}
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+
+	var d time.Duration
+	if rl.tokens < 0 {
+		d = time.Duration(-rl.tokens / rate * float64(time.Second))
+	}
+	rl.mu.Unlock()
+	time.Sleep(d)
+}
+
+func (bw *bandwidth) setRate(rate int64) {
+	bw.up.SetRate(rate)
+	bw.down.SetRate(rate)
+}
+
+// setRate 修改速率, 包括已有的连接
+func (lg *limiterGroup) setRate(rate int64) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	lg.rate = rate
+	for _, e := range lg.m {
+		e.setRate(rate)
+	}
+}
+
+// get 返回 key 的限速, 连接关闭时调用 release
+func (lg *limiterGroup) get(key string) (bw *bandwidth, release func()) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if lg.m == nil {
+		lg.m = map[string]*groupEntry{}
+	}
+	e, ok := lg.m[key]
+	if !ok {
+		e = &groupEntry{}
+		e.setRate(lg.rate)
+		lg.m[key] = e
+	}
+	e.refs++
+	return &e.bandwidth, func() {
+		lg.mu.Lock()
+		defer lg.mu.Unlock()
+		e.refs--
+		if e.refs == 0 {
+			delete(lg.m, key)
+		}
+	}
+}
+
+// SetRateLimit 设置该监听的总速率, 每个认证用户和每个客户端 IP 的速率,
+// 单位为字节/秒, 上传和下载分别计算, 0 为不限速. 对已有的连接立即生效.
+func (thc *TunnelHTTPClient) SetRateLimit(total, perUser, perIP int64) {
+	thc.limits.total.setRate(total)
+	thc.limits.user.setRate(perUser)
+	thc.limits.ip.setRate(perIP)
+}
+
+// limit 按全局, 监听, 用户和客户端 IP 的限速包装连接
+func (thc *TunnelHTTPClient) limit(conn net.Conn) net.Conn {
+	lc := &limitConn{
+		Conn: conn,
+	}
+	add := func(bw *bandwidth) {
+		lc.up = append(lc.up, &bw.up)
+		lc.down = append(lc.down, &bw.down)
+	}
+
+	if thc.global != nil {
+		add(thc.global)
+	}
+	add(&thc.limits.total)
+	if thc.user != "" {
+		bw, release := thc.limits.user.get(thc.user)
+		add(bw)
+		lc.release = append(lc.release, release)
+	}
+	if ip := remoteIP(conn); ip != "" {
+		bw, release := thc.limits.ip.get(ip)
+		add(bw)
+		lc.release = append(lc.release, release)
+	}
+	return lc
+}
+
+// remoteIP 客户端的 IP, unix socket 等没有 IP 时返回空
+func remoteIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+func (lc *limitConn) Read(b []byte) (n int, err error) {
+	n, err = lc.Conn.Read(b)
+	for _, rl := range lc.up {
+		rl.wait(n)
+	}
+	return
+}
+
+func (lc *limitConn) Write(b []byte) (n int, err error) {
+	for _, rl := range lc.down {
+		rl.wait(len(b))
+	}
+	return lc.Conn.Write(b)
+}
+
+func (lc *limitConn) Close() error {
+	lc.once.Do(func() {
+		for _, release := range lc.release {
+			release()
+		}
+	})
+	return lc.Conn.Close()
+}
@@ -30,7 +30,7 @@ func (thc *TunnelHTTPClient) handleRedirect(c net.Conn) {
 	}
 	defer conn.Close()
 
-	thc.handle(conn, converter.ToBytes(dstAddr.String()))
+	thc.handle(conn, converter.ToBytes(dstAddr.String()), nil)
 }
 
 func getOriginalDstAddr(conn *net.TCPConn) (addr net.Addr, c *net.TCPConn, err error) {
@@ -3,20 +3,75 @@ package tunnelclient
 import (
 	"bytes"
 	"github.com/iikira/BaiduPCS-Go/pcsutil/converter"
-	"net/http"
-	"strconv"
+	"io"
+	"net"
 	"strings"
 )
 
+const (
+	// RelayDirect 中继请求不经过代理, 直接连接隧道的目标
+	RelayDirect = "direct"
+
+	httpScheme = "http://"
+)
+
 // SetRelayMethod 设置允许HTTP流量中继的方法
 func (thc *TunnelHTTPClient) SetRelayMethod(methods string) {
-	ms := strings.Split(methods, ",")
-	for k := range ms {
-		ms[k] = strings.TrimSpace(ms[k])
+	var ms []string
+	for _, m := range strings.Split(methods, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		ms = append(ms, m)
 	}
 	thc.relayMethod = ms
 }
 
+// SetRelayUpstream 设置 RelayMethod 请求发往的 HTTP 代理,
+// 为空时使用第一个上游, 为 RelayDirect 时直接连接隧道的目标
+func (thc *TunnelHTTPClient) SetRelayUpstream(addr string) {
+	thc.relayAddr = addr
+}
+
+// SetRelayHeadersFunc 设置 RelayMethod 请求添加的请求头, 为空时与 CONNECT 相同
+func (thc *TunnelHTTPClient) SetRelayHeadersFunc(fn HeadersFunc) {
+	thc.relayHeadersFunc = fn
+}
+
+// relayHeaders 中继请求添加的请求头, 发往第一个代理时包括其 Basic 认证
+func (thc *TunnelHTTPClient) relayHeaders() HeadersFunc {
+	switch {
+	case thc.relayHeadersFunc != nil:
+		return thc.relayHeadersFunc
+	case thc.relayAddr == "":
+		hop := thc.hops()[0]
+		return hop.ProxyHeaders
+	}
+	return thc.headersFunc
+}
+
+// relayDialAddr 中继请求连接的地址, host 为隧道的目标
+func (thc *TunnelHTTPClient) relayDialAddr(host []byte) string {
+	switch thc.relayAddr {
+	case "":
+		return thc.hops()[0].Addr
+	case RelayDirect:
+		return string(host)
+	}
+	return thc.relayAddr
+}
+
+// canRelay 是否需要按请求区分中继.
+// 未单独设置中继的上游时, 只有第一个上游为 HTTP 代理才能直接发送 HTTP 请求, 否则所有流量都通过隧道.
+func (thc *TunnelHTTPClient) canRelay() bool {
+	if len(thc.relayMethod) == 0 {
+		return false
+	}
+	return thc.relayAddr != "" || thc.hops()[0].Type == HopHTTP
+}
+
+// isNeedRelay 请求行的方法是否在 RelayMethod 中
 func (thc *TunnelHTTPClient) isNeedRelay(data []byte) bool {
 	for _, m := range thc.relayMethod {
 		if bytes.HasPrefix(data, converter.ToBytes(m+" ")) {
@@ -26,95 +81,99 @@ func (thc *TunnelHTTPClient) isNeedRelay(data []byte) bool {
 	return false
 }
 
-func (thc *TunnelHTTPClient) checkRelay(data []byte) (isRelay bool, remainLength int64, newData []byte) {
-	if !thc.isNeedRelay(data) {
-		newData = data
-		return
-	}
+// SetRelayAbsoluteURI 为 true 时, 发往代理的中继请求的请求行改写为 GET http://host/path HTTP/1.1
+func (thc *TunnelHTTPClient) SetRelayAbsoluteURI(b bool) {
+	thc.relayAbsoluteURI = b
+}
 
-	i := bytes.Index(data, []byte{'\r', '\n'})
-	if i == -1 {
-		newData = data
-		return
-	}
+// hasHTTPScheme 请求目标是否为 absolute-form, 协议名不区分大小写
+func hasHTTPScheme(target []byte) bool {
+	return len(target) >= len(httpScheme) && bytes.EqualFold(target[:len(httpScheme)], []byte(httpScheme))
+}
 
-	// 是否符合3个字段
-	fields := bytes.Fields(data[:i])
-	if len(fields) != 3 {
-		newData = data
-		return
+// splitAbsoluteURI 将 absolute-form 分为 authority 和 origin-form, 没有路径时为 /
+func splitAbsoluteURI(target []byte) (authority, path []byte) {
+	rest := target[len(httpScheme):]
+	i := bytes.IndexAny(rest, "/?#")
+	if i < 0 {
+		return rest, []byte("/")
+	}
+	authority, path = rest[:i], rest[i:]
+	if path[0] != '/' {
+		path = append([]byte("/"), path...)
 	}
+	return
+}
 
-	// 是否有结束字段
-	endI := bytes.Index(data[i+2:], []byte{'\r', '\n', '\r', '\n'})
-	if endI == -1 {
-		remainLength = -1
-		newData = data
-		return
+// httpAuthority 去掉 host:port 中的默认端口 80
+func httpAuthority(hostport []byte) []byte {
+	host, port, err := net.SplitHostPort(string(hostport))
+	if err != nil || port != "80" {
+		return hostport
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
 	}
+	return []byte(host)
+}
 
-	// 检测Content-Length和host
-	isRelay = true
-	var (
-		contentLength int64 = -1
-		host          []byte
-		headers       string
-	)
-	headerLines := bytes.Split(data[i:i+2+endI], []byte{'\r', '\n'})
-	for _, line := range headerLines {
-		s := bytes.SplitN(line, []byte{':'}, 2)
-		if len(s) != 2 {
-			continue
+// rewriteRequestLine 发往代理时按需改写为 absolute-form, 直连时改回 origin-form.
+// host 为 Host 请求头, 没有时使用隧道的目标 tunnelHost.
+func (thc *TunnelHTTPClient) rewriteRequestLine(fields [][]byte, host, tunnelHost []byte) []byte {
+	target := fields[1]
+	switch {
+	case thc.relayAddr == RelayDirect:
+		if !hasHTTPScheme(target) {
+			return nil
 		}
-
-		if contentLength < 0 {
-			contentLength = parseContentLength(s)
+		_, target = splitAbsoluteURI(target)
+	case thc.relayAbsoluteURI:
+		if !bytes.HasPrefix(target, []byte("/")) {
+			return nil
 		}
 		if host == nil {
-			host = parseHost(s)
-		}
-		if host != nil && contentLength >= 0 {
-			break
+			host = httpAuthority(tunnelHost)
 		}
+		target = append(append([]byte(httpScheme), host...), target...)
+	default:
+		return nil
 	}
-
-	if thc.headersFunc != nil {
-		headers = thc.headersFunc(host)
-		newData = make([]byte, 0, len(data)+len(headers))
-		newData = append(newData, data[:i+2]...)
-		newData = append(newData, headers...)
-		newData = append(newData, data[i+2:]...)
-	} else {
-		newData = data
-	}
-
-	// 未检测到Content-Length
-	if contentLength < 0 {
-		remainLength = -1
-		return
-	}
-
-	remainLength = contentLength - int64(len(data)-(i+2+endI+4))
-	return
+	return bytes.Join([][]byte{fields[0], target, fields[2]}, []byte{' '})
 }
 
-func parseContentLength(splitedHeader [][]byte) int64 {
-	if strings.Compare(http.CanonicalHeaderKey(converter.ToString(splitedHeader[0])), "Content-Length") != 0 {
-		return -2
+// relayTarget 中继请求最终连接的 host:port, 用于检查目标.
+// 发往代理时为 absolute-form 的 authority 或 Host 请求头, 没有端口时为 80.
+func (thc *TunnelHTTPClient) relayTarget(head *httpHead, fields [][]byte, tunnelHost []byte) []byte {
+	if thc.relayAddr == RelayDirect {
+		return tunnelHost
 	}
-
-	i, err := strconv.ParseInt(converter.ToString(bytes.TrimSpace(splitedHeader[1])), 10, 64)
-	if err != nil {
-		return -3
+	var authority []byte
+	switch {
+	case hasHTTPScheme(fields[1]):
+		authority, _ = splitAbsoluteURI(fields[1])
+	case head.get("Host") != nil:
+		authority = head.get("Host")
+	default:
+		return tunnelHost
 	}
-
-	return i
+	if _, _, err := net.SplitHostPort(string(authority)); err != nil {
+		return []byte(net.JoinHostPort(strings.Trim(string(authority), "[]"), "80"))
+	}
+	return authority
 }
 
-func parseHost(splitedHeader [][]byte) []byte {
-	if strings.Compare(http.CanonicalHeaderKey(converter.ToString(splitedHeader[0])), "Host") != 0 {
-		return nil
+// relayRequest 发送中继请求, 添加请求头并改写请求行
+func (thc *TunnelHTTPClient) relayRequest(w io.Writer, head *httpHead, fields [][]byte, tunnelHost []byte) error {
+	var (
+		host    = head.get("Host")
+		headers string
+	)
+	if headersFunc := thc.relayHeaders(); headersFunc != nil {
+		headers = headersFunc(host)
 	}
-
-	return bytes.TrimSpace(splitedHeader[1])
+	line := thc.rewriteRequestLine(fields, host, tunnelHost)
+	if line == nil {
+		line = head.line
+	}
+	return head.writeTo(w, line, headers)
 }
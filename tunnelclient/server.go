@@ -0,0 +1,78 @@
+package tunnelclient
+
+import (
+	"fmt"
+	"log"
+)
+
+type (
+	// Server 在一个进程中运行多个监听, 各监听共享统计
+	Server struct {
+		Metrics   *Metrics
+		global    bandwidth
+		listeners []*TunnelHTTPClient
+	}
+)
+
+func NewServer() *Server {
+	return &Server{
+		Metrics: &Metrics{},
+	}
+}
+
+// Add 添加监听, 监听以 Name 区分, 启动时使用其 Mode
+func (s *Server) Add(thc *TunnelHTTPClient) {
+	thc.metrics = s.Metrics
+	thc.global = &s.global
+	s.listeners = append(s.listeners, thc)
+}
+
+// SetRateLimit 设置所有监听共享的速率, 单位为字节/秒, 上传和下载分别计算, 0 为不限速
+func (s *Server) SetRateLimit(rate int64) {
+	s.global.setRate(rate)
+}
+
+// Listener 返回名为 name 的监听, 不存在时返回 nil
+func (s *Server) Listener(name string) *TunnelHTTPClient {
+	for _, l := range s.listeners {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Listeners 返回所有监听
+func (s *Server) Listeners() []*TunnelHTTPClient {
+	return s.listeners
+}
+
+// ListenAndServe 启动所有监听, 任意一个无法监听时返回.
+// 运行中某个监听出错时只停止该监听, 所有监听都停止后返回.
+func (s *Server) ListenAndServe() error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("no listener")
+	}
+
+	errCh := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func(l *TunnelHTTPClient) {
+			// 重新加载时会同时修改配置, 监听使用启动时的副本
+			c := l.clone()
+			listener, err := c.Listen()
+			if err != nil {
+				errCh <- fmt.Errorf("%s (%s %s): %s", c.Name, c.Mode, c.LocalAddr, err)
+				return
+			}
+			err = l.Serve(listener, c.Mode)
+			log.Printf("%s (%s %s): stopped: %s\n", c.Name, c.Mode, c.LocalAddr, err)
+			errCh <- nil
+		}(l)
+	}
+	for range s.listeners {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("all listeners stopped")
+}
@@ -0,0 +1,290 @@
+package tunnelclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+type (
+	// session 隧道内的 HTTP/1.1 请求按方法分别发往隧道或中继,
+	// 响应按请求的顺序返回给客户端
+	session struct {
+		thc  *TunnelHTTPClient
+		conn net.Conn
+		host []byte // 隧道的目标
+
+		mu      sync.Mutex
+		closed  bool
+		tunnel  *upstreamConn
+		relay   *upstreamConn
+		pending chan *pendingResponse
+	}
+
+	upstreamConn struct {
+		net.Conn
+		r *bufio.Reader
+	}
+
+	// pendingResponse 等待返回给客户端的响应
+	pendingResponse struct {
+		up      *upstreamConn
+		method  []byte
+		upgrade bool   // CONNECT 或 Upgrade 请求, 上游同意后不再按 HTTP 解析
+		errResp string // 非空时直接返回给客户端, 之后结束会话
+
+		// switched 为 upgrade 请求的结果, 上游返回 101 (CONNECT 为 2xx) 时为 true
+		switched chan bool
+	}
+)
+
+const (
+	// maxPipeline 最多同时等待响应的请求数
+	maxPipeline = 32
+)
+
+// handleHTTP 按请求中继, 第一个请求之前的数据已在 r 中, tunnel 不为 nil 时作为隧道的连接
+func (thc *TunnelHTTPClient) handleHTTP(conn net.Conn, r *bufio.Reader, host []byte, tunnel net.Conn) {
+	s := &session{
+		thc:     thc,
+		conn:    conn,
+		host:    host,
+		pending: make(chan *pendingResponse, maxPipeline),
+	}
+	if tunnel != nil {
+		s.tunnel = &upstreamConn{
+			Conn: tunnel,
+			r:    bufio.NewReader(tunnel),
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.writeResponses()
+		close(done)
+	}()
+
+	s.readRequests(r)
+	close(s.pending)
+	<-done
+}
+
+// keep 记录上游连接, 会话已结束时关闭该连接并返回 false
+func (s *session) keep(field **upstreamConn, up *upstreamConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		up.Close()
+		return false
+	}
+	*field = up
+	return true
+}
+
+// close 关闭所有连接
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, up := range []*upstreamConn{s.tunnel, s.relay} {
+		if up != nil {
+			up.Close()
+		}
+	}
+	s.conn.Close()
+}
+
+// readRequests 读取客户端的请求, 发往对应的上游, 并将等待的响应加入队列
+func (s *session) readRequests(r *bufio.Reader) {
+	for {
+		head, err := readHead(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("RELAY: read request from %s error: %s\n", s.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		fields := bytes.Fields(head.line)
+		if len(fields) != 3 {
+			log.Printf("RELAY: unknown request line: %q\n", head.line)
+			return
+		}
+		length, err := head.requestBodyLength()
+		if err != nil {
+			log.Printf("RELAY: %s %s: %s\n", fields[0], fields[1], err)
+			return
+		}
+
+		p := &pendingResponse{
+			method:  fields[0],
+			upgrade: bytes.Equal(fields[0], []byte("CONNECT")) || head.hasToken("Connection", "upgrade"),
+		}
+		isRelay := s.thc.isNeedRelay(head.line)
+		if isRelay {
+			// 代理按 Host 请求头连接, 可能与隧道的目标不同
+			if s.thc.checkDest(s.conn, s.thc.relayTarget(head, fields, s.host)) != nil {
+				p.errResp = fmt.Sprintf("%s 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", fields[2])
+				s.pending <- p
+				return
+			}
+			p.up, p.errResp = s.dialRelay()
+		} else {
+			p.up, p.errResp = s.dialTunnel()
+		}
+		if p.up == nil {
+			if p.errResp != "" {
+				s.pending <- p
+			}
+			return
+		}
+
+		if isRelay {
+			err = s.thc.relayRequest(p.up, head, fields, s.host)
+		} else {
+			err = head.writeTo(p.up, head.line, "")
+		}
+		if err != nil {
+			return
+		}
+		if p.upgrade {
+			p.switched = make(chan bool, 1)
+		}
+		// 先加入队列, 以便在上传消息体时返回 100 Continue 等响应
+		s.pending <- p
+
+		err = copyBody(p.up, r, length)
+		if err != nil {
+			log.Printf("RELAY: copy request body to %s error: %s\n", p.up.RemoteAddr(), err)
+			return
+		}
+		// 上游同意切换协议后原样转发, 拒绝时继续读取之后的请求
+		if p.upgrade && <-p.switched {
+			io.Copy(p.up, r)
+			return
+		}
+	}
+}
+
+// decide 通知 readRequests upgrade 请求的结果, 只有第一次有效
+func (p *pendingResponse) decide(switched bool) {
+	if p.switched == nil {
+		return
+	}
+	select {
+	case p.switched <- switched:
+	default:
+	}
+}
+
+// dialRelay 返回中继的连接, 第一次使用时建立
+func (s *session) dialRelay() (up *upstreamConn, errResp string) {
+	if s.relay != nil {
+		return s.relay, ""
+	}
+	relayAddr := s.thc.relayDialAddr(s.host)
+	conn, err := s.thc.dial(relayAddr)
+	if err != nil {
+		s.thc.metrics.upstreamFailed()
+		log.Printf("RELAY: dial2 %s error: %s\n", relayAddr, err)
+		return nil, s.thc.errorResponse(s.host, relayAddr, err)
+	}
+	up = &upstreamConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	if !s.keep(&s.relay, up) {
+		return nil, ""
+	}
+	return up, ""
+}
+
+// dialTunnel 返回隧道的连接, 第一次使用时建立
+func (s *session) dialTunnel() (up *upstreamConn, errResp string) {
+	if s.tunnel != nil {
+		return s.tunnel, ""
+	}
+	conn, err := s.thc.dialTunnel(s.host)
+	if err != nil {
+		// 客户端在隧道内发送的是 HTTP 请求, 可以返回 HTTP 错误响应
+		s.thc.tunnelFailed(s.host, err)
+		return nil, s.thc.errorResponse(s.host, s.thc.chainString(), err)
+	}
+	up = &upstreamConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+	if !s.keep(&s.tunnel, up) {
+		return nil, ""
+	}
+	return up, ""
+}
+
+// writeResponses 按请求的顺序读取响应, 写给客户端
+func (s *session) writeResponses() {
+	defer func() {
+		s.close()
+		for p := range s.pending { // 让 readRequests 不会阻塞
+			p.decide(false)
+		}
+	}()
+
+	for p := range s.pending {
+		if p.errResp != "" {
+			io.WriteString(s.conn, p.errResp)
+			return
+		}
+		err := s.copyResponse(p)
+		if err != nil {
+			p.decide(false)
+			if err != io.EOF {
+				log.Printf("RELAY: copy response from %s error: %s\n", p.up.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// copyResponse 复制一个完整的响应, 包括之前的 1xx 响应.
+// 返回 io.EOF 表示上游连接已经结束, 会话也随之结束.
+func (s *session) copyResponse(p *pendingResponse) error {
+	for {
+		head, err := readHead(p.up.r)
+		if err != nil {
+			return err
+		}
+		err = head.writeTo(s.conn, head.line, "")
+		if err != nil {
+			return err
+		}
+
+		code := head.statusCode()
+		if code == 0 {
+			return fmt.Errorf("unknown status line: %q", head.line)
+		}
+		if p.upgrade && (code == 101 || (code >= 200 && code < 300 && bytes.Equal(p.method, []byte("CONNECT")))) {
+			p.decide(true)
+			io.Copy(s.conn, p.up.r)
+			return io.EOF
+		}
+		if code >= 100 && code < 200 {
+			continue
+		}
+		p.decide(false)
+
+		length, err := head.responseBodyLength(p.method)
+		if err != nil {
+			return err
+		}
+		err = copyBody(s.conn, p.up.r, length)
+		if err != nil {
+			return err
+		}
+		if length == bodyUntilEOF {
+			return io.EOF
+		}
+		return nil
+	}
+}
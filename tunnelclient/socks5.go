@@ -2,14 +2,16 @@ package tunnelclient
 
 import (
 	"github.com/ginuerzh/gosocks5"
-	"github.com/ginuerzh/gosocks5/server"
 	"github.com/iikira/BaiduPCS-Go/pcsutil/converter"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"syscall"
 )
 
 func (thc *TunnelHTTPClient) handleSocks5(conn net.Conn) {
-	conn = gosocks5.ServerConn(conn, server.DefaultSelector)
+	conn = gosocks5.ServerConn(conn, thc.socks5Selector())
 	req, err := gosocks5.ReadRequest(conn)
 	if err != nil {
 		log.Printf("socks5: read request error: %s\n", err)
@@ -26,7 +28,8 @@ func (thc *TunnelHTTPClient) handleSocks5(conn net.Conn) {
 	case gosocks5.CmdUdp:
 		fallthrough
 	default:
-		log.Printf("%d: unsupported command", gosocks5.CmdUnsupported)
+		log.Printf("socks5: unsupported command %d\n", req.Cmd)
+		gosocks5.NewReply(gosocks5.CmdUnsupported, nil).Write(conn)
 		conn.Close()
 		return
 	}
@@ -34,11 +37,65 @@ func (thc *TunnelHTTPClient) handleSocks5(conn net.Conn) {
 
 func (thc *TunnelHTTPClient) handleSocks5Connect(conn net.Conn, req *gosocks5.Request) {
 	defer conn.Close()
-	rep := gosocks5.NewReply(gosocks5.Succeeded, nil)
+	host := converter.ToBytes(req.Addr.String())
+	if thc.checkDest(conn, host) != nil {
+		gosocks5.NewReply(gosocks5.NotAllowed, nil).Write(conn)
+		return
+	}
+
+	// 上游建立隧道后再回复, 使客户端得到真实的结果
+	tunnel, err := thc.dialTunnel(host)
+	if err != nil {
+		thc.metrics.upstreamFailed()
+		log.Printf("CONNECT %s through %s error: %s\n", host, thc.chainString(), err)
+		gosocks5.NewReply(socks5Reply(err), nil).Write(conn)
+		return
+	}
+
+	// BND.ADDR 为连接上游的本地地址
+	bindAddr, _ := gosocks5.NewAddr(tunnel.LocalAddr().String())
+	rep := gosocks5.NewReply(gosocks5.Succeeded, bindAddr)
 	if err := rep.Write(conn); err != nil {
 		log.Printf("socks5 reply error: %s\n", err)
+		tunnel.Close()
 		return
 	}
 
-	thc.handle(conn, converter.ToBytes(req.Addr.String()))
+	thc.handle(conn, host, tunnel)
+}
+
+// socks5Reply 将连接上游的错误转换为 SOCKS5 的回复
+func socks5Reply(err error) uint8 {
+	switch e := err.(type) {
+	case *SocksError:
+		if e.Type == HopSOCKS5 {
+			return e.Reply
+		}
+		return gosocks5.Failure
+	case *ConnectError:
+		switch e.StatusCode() {
+		case http.StatusForbidden, http.StatusProxyAuthRequired:
+			return gosocks5.NotAllowed
+		case http.StatusBadGateway, http.StatusServiceUnavailable:
+			return gosocks5.HostUnreachable
+		case http.StatusGatewayTimeout:
+			return gosocks5.TTLExpired
+		}
+		return gosocks5.Failure
+	case *net.OpError:
+		if se, ok := e.Err.(*os.SyscallError); ok {
+			switch se.Err {
+			case syscall.ECONNREFUSED:
+				return gosocks5.ConnRefused
+			case syscall.ENETUNREACH:
+				return gosocks5.NetUnreachable
+			case syscall.EHOSTUNREACH:
+				return gosocks5.HostUnreachable
+			}
+		}
+		if e.Timeout() {
+			return gosocks5.TTLExpired
+		}
+	}
+	return gosocks5.Failure
 }
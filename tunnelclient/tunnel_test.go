@@ -1,62 +1,1308 @@
 package tunnelclient_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
-	"golang.org/x/net/proxy"
-	"log"
+	"github.com/ginuerzh/gosocks5"
+	"github.com/ginuerzh/gosocks5/server"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"html/template"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-func TestSocks5Tunnel(t *testing.T) {
-	proxyUrl, _ := url.Parse("socks5://127.0.0.1:1099")
+// fakeUpstream 模拟上游 HTTP 代理, 只允许 CONNECT 到 allowed
+func fakeUpstream(t *testing.T, allowed string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Host != allowed || req.Header.Get("X-Test") != "1" {
+					conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}()
+		}
+	}()
+	return l
+}
+
+// forwardProxy 模拟转发的上游代理, HTTP 时处理 CONNECT, SOCKS5 时处理 CONNECT, 有 users 时要求认证
+func forwardProxy(t *testing.T, hopType tunnelclient.HopType, users ...*url.Userinfo) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var (
+					target string
+					client io.ReadWriter = conn
+				)
+				if hopType == tunnelclient.HopSOCKS5 {
+					selector := server.DefaultSelector
+					if len(users) > 0 {
+						selector = server.NewServerSelector(users, gosocks5.MethodUserPass)
+					}
+					sc := gosocks5.ServerConn(conn, selector)
+					req, err := gosocks5.ReadRequest(sc)
+					if err != nil {
+						return
+					}
+					target, client = req.Addr.String(), sc
+				} else {
+					r := bufio.NewReader(conn)
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					target = req.Host
+				}
+
+				dest, err := net.Dial("tcp", target)
+				if err != nil {
+					if hopType == tunnelclient.HopSOCKS5 {
+						gosocks5.NewReply(gosocks5.ConnRefused, nil).Write(client)
+					} else {
+						io.WriteString(client, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					}
+					return
+				}
+				defer dest.Close()
+				if hopType == tunnelclient.HopSOCKS5 {
+					gosocks5.NewReply(gosocks5.Succeeded, nil).Write(client)
+				} else {
+					io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+				}
+				go io.Copy(dest, client)
+				io.Copy(client, dest)
+			}()
+		}
+	}()
+	return l
+}
 
-	var dialer proxy.Dialer
-	dialer, _ = proxy.FromURL(proxyUrl, &net.Dialer{
+func TestChain(t *testing.T) {
+	hop1 := forwardProxy(t, tunnelclient.HopHTTP)
+	defer hop1.Close()
+	hop2 := forwardProxy(t, tunnelclient.HopSOCKS5)
+	defer hop2.Close()
+	hop3 := fakeUpstream(t, "example.com:443")
+	defer hop3.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.SetChain([]tunnelclient.Hop{
+		{Type: tunnelclient.HopHTTP, Addr: hop1.Addr().String()},
+		{Type: tunnelclient.HopSOCKS5, Addr: hop2.Addr().String()},
+		{Type: tunnelclient.HopHTTP, Addr: hop3.Addr().String(), Headers: func(host []byte) string {
+			return "X-Test: 1\r\n"
+		}},
 	})
 
-	conn, err := dialer.Dial("tcp", "101.132.157.18:80")
+	res, err := tc.Probe("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.StatusLine, "200") {
+		t.Errorf("unexpected status: %s", res.StatusLine)
+	}
+
+	// 第二个代理连不上第三个
+	hop3.Close()
+	_, err = tc.Probe("example.com:443")
+	if se, ok := err.(*tunnelclient.SocksError); !ok || se.Reply != gosocks5.ConnRefused {
+		t.Fatalf("expected SocksError, got %v", err)
+	}
+}
+
+func TestSocks5Upstream(t *testing.T) {
+	proxy := forwardProxy(t, tunnelclient.HopSOCKS5, url.UserPassword("alice", "secret"))
+	defer proxy.Close()
+	target := fakeUpstream(t, "example.com:443")
+	defer target.Close()
+
+	hop := tunnelclient.Hop{
+		Type:     tunnelclient.HopSOCKS5,
+		Addr:     proxy.Addr().String(),
+		Username: "alice",
+		Password: "secret",
+	}
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.SetChain([]tunnelclient.Hop{hop})
+
+	res, err := tc.Probe(target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusLine != "socks5 reply 0" {
+		t.Errorf("unexpected status: %s", res.StatusLine)
+	}
+
+	hop.Password = "wrong"
+	tc.SetChain([]tunnelclient.Hop{hop})
+	_, err = tc.Probe(target.Addr().String())
+	if err != gosocks5.ErrAuthFailure {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	l := fakeUpstream(t, "example.com:443")
+	defer l.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = l.Addr().String()
+	tc.SetHeadersFunc(func(host []byte) string {
+		return "X-Test: 1\r\n"
+	})
+
+	res, err := tc.Probe("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.StatusLine, "200") {
+		t.Errorf("unexpected status: %s", res.StatusLine)
+	}
+
+	res, err = tc.Probe("example.com:25")
+	if _, ok := err.(*tunnelclient.ConnectError); !ok {
+		t.Fatalf("expected ConnectError, got %v", err)
+	}
+	if !strings.Contains(res.StatusLine, "403") {
+		t.Errorf("unexpected status: %s", res.StatusLine)
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:8080":       true,
+		":1080":                true,
+		"unix:/run/proxy.sock": true,
+		"systemd:":             true,
+		"systemd:web":          true,
+		"unix:":                false,
+		"127.0.0.1":            false,
+		"127.0.0.1:70000":      false,
+		"/run/proxy.sock":      false,
+	} {
+		err := tunnelclient.CheckListenAddr(addr)
+		if (err == nil) != ok {
+			t.Errorf("%s: unexpected result %v", addr, err)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tunnelclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+
+	// 残留的 socket 文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.LocalAddr = tunnelclient.UnixPrefix + path
+	tc.SocketMode = 0600
+	l, err := tc.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode: got %v %v, want 0600", info, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary files left: %d files", len(files))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 仍在使用的 socket 不能被替换
+	if _, err := tc.Listen(); err == nil {
+		t.Error("listening on a socket in use should fail")
+	}
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed on close: %v", err)
+	}
+
+	// 不是 socket 的文件不会被删除
+	ioutil.WriteFile(path, []byte("data"), 0644)
+	if _, err := tc.Listen(); err == nil {
+		t.Error("listening on a regular file should fail")
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "data" {
+		t.Error("regular file was replaced")
+	}
+}
+
+// serve 在本地端口启动 tc, 返回监听的地址
+func serve(t *testing.T, tc *tunnelclient.TunnelHTTPClient, st tunnelclient.ServMode) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tc.Serve(l, st)
+	return l.Addr().String()
+}
+
+func TestRelayOrder(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/chunked":
+			io.WriteString(w, "chunk1,")
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer origin.Close()
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = proxy.Addr().String()
+	tc.SetRelayMethod("GET,HEAD")
+	tc.SetRelayUpstream(tunnelclient.RelayDirect)
+
+	conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	host := origin.Listener.Addr().String()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+
+	// GET 和 HEAD 直连, POST 通过隧道, 第一个请求的响应最慢
+	requests := []struct {
+		method, path, body string
+	}{
+		{"GET", "/slow", ""},
+		{"POST", "/post", "data"},
+		{"HEAD", "/head", ""},
+		{"GET", "/chunked", ""},
+		{"POST", "/post2", "data"},
+	}
+	for _, req := range requests {
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", req.method, req.path, host, len(req.body), req.body)
+	}
+
+	for _, req := range requests {
+		res, err := http.ReadResponse(r, &http.Request{Method: req.method})
+		if err != nil {
+			t.Fatalf("%s %s: %s", req.method, req.path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: %s", req.method, req.path, err)
+		}
+
+		want := req.method + " " + req.path
+		switch req.method {
+		case "HEAD":
+			want = ""
+		}
+		if req.path == "/chunked" {
+			want = "chunk1," + want
+		}
+		if string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			io.WriteString(w, r.URL.Path)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, rw)
+	}))
+	defer origin.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = "127.0.0.1:1"
+	tc.SetRelayMethod("GET")
+	tc.SetRelayUpstream(tunnelclient.RelayDirect)
+
+	conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	host := origin.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+
+	// 上游不支持 h2c, 返回 200 后继续按 HTTP 处理之后的请求
+	for _, req := range []struct{ path, headers string }{
+		{"/upgrade", "Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n"},
+		{"/next", ""},
+	} {
+		io.WriteString(conn, "GET "+req.path+" HTTP/1.1\r\nHost: "+host+"\r\n"+req.headers+"\r\n")
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", req.path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil || res.StatusCode != 200 || string(body) != req.path {
+			t.Errorf("%s: got %d %q %v", req.path, res.StatusCode, body, err)
+		}
+	}
+
+	// 上游同意后原样转发
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+host+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	res, err = http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != 101 {
+		t.Fatalf("upgrade: got %v %v, want 101", res, err)
+	}
+	io.WriteString(conn, "GET /raw HTTP/1.1\r\n")
+	line, err := r.ReadString('\n')
+	if line != "GET /raw HTTP/1.1\r\n" {
+		t.Errorf("after 101: got %q %v", line, err)
+	}
+}
+
+// echoHeader 模拟中继的上游, 在响应中返回收到的 keys 请求头, 以逗号分隔
+func echoHeader(t *testing.T, keys ...string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				values := make([]string, len(keys))
+				for k, key := range keys {
+					values[k] = req.Header.Get(key)
+				}
+				value := strings.Join(values, ",")
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(value), value)
+			}()
+		}
+	}()
+	return l
+}
+
+// relayGet 通过 tc 的隧道发送一个中继的 GET 请求, 返回响应的消息体
+func relayGet(t *testing.T, tc *tunnelclient.TunnelHTTPClient) string {
+	conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT example.com:80 HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err := http.ReadResponse(r, nil)
+	if err == nil {
+		res, err = http.ReadResponse(r, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestRelayHeaders(t *testing.T) {
+	upstream := echoHeader(t, "Proxy-Authorization", "X-Relay")
+	defer upstream.Close()
+	headers := func(value string) tunnelclient.HeadersFunc {
+		return func(host []byte) string {
+			return "X-Relay: " + value + "\r\n"
+		}
+	}
+
+	// 发往第一个代理时带上其 Basic 认证
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.SetRelayMethod("GET")
+	tc.SetChain([]tunnelclient.Hop{
+		{Type: tunnelclient.HopHTTP, Addr: upstream.Addr().String(), Headers: headers("connect"), Username: "alice", Password: "secret"},
+	})
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")) + ",connect"
+	if got := relayGet(t, tc); got != want {
+		t.Errorf("first hop: got %q, want %q", got, want)
+	}
+
+	// 单独的中继上游默认使用 CONNECT 的请求头, 不带第一个代理的认证
+	tc = tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = "127.0.0.1:1"
+	tc.SetHeadersFunc(headers("connect"))
+	tc.SetRelayMethod("GET")
+	tc.SetRelayUpstream(upstream.Addr().String())
+	if got := relayGet(t, tc); got != ",connect" {
+		t.Errorf("relay upstream: got %q, want %q", got, ",connect")
+	}
+
+	tc.SetRelayHeadersFunc(headers("relay"))
+	if got := relayGet(t, tc); got != ",relay" {
+		t.Errorf("relay headers: got %q, want %q", got, ",relay")
+	}
+}
+
+// echoRequestLine 模拟中继的上游, 在响应中返回收到的请求行
+func echoRequestLine(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimSpace(line)
+				fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(line), line)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRewriteRequestLine(t *testing.T) {
+	upstream := echoRequestLine(t)
+	defer upstream.Close()
+	echo := upstream.Addr().String()
+
+	tests := []struct {
+		name        string
+		direct      bool
+		absoluteURI bool
+		tunnelHost  string
+		request     string
+		want        string
+	}{
+		{"origin to absolute", false, true, "example.com:80",
+			"GET /a?b=1 HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "GET http://example.com:8080/a?b=1 HTTP/1.1"},
+		{"missing Host", false, true, "example.com:80",
+			"GET /a HTTP/1.1\r\n\r\n", "GET http://example.com/a HTTP/1.1"},
+		{"missing Host with port", false, true, "example.com:8080",
+			"GET /a HTTP/1.1\r\n\r\n", "GET http://example.com:8080/a HTTP/1.1"},
+		{"absolute kept", false, true, "example.com:80",
+			"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET http://example.com/a HTTP/1.1"},
+		{"origin kept", false, false, "example.com:80",
+			"GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET /a HTTP/1.1"},
+		{"absolute to origin", true, false, echo,
+			"GET http://example.com/a?b=1 HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET /a?b=1 HTTP/1.1"},
+		{"scheme case", true, false, echo,
+			"GET HTTP://Example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET /a HTTP/1.1"},
+		{"authority without path", true, false, echo,
+			"GET http://example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET / HTTP/1.1"},
+		{"authority with query", true, false, echo,
+			"GET http://example.com?a HTTP/1.1\r\nHost: example.com\r\n\r\n", "GET /?a HTTP/1.1"},
+	}
+	for _, test := range tests {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.DestAddr = "127.0.0.1:1" // 中继的请求不经过隧道
+		tc.SetRelayMethod("GET")
+		tc.SetRelayUpstream(echo)
+		if test.direct {
+			tc.SetRelayUpstream(tunnelclient.RelayDirect)
+		}
+		tc.SetRelayAbsoluteURI(test.absoluteURI)
+
+		conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+test.tunnelHost+" HTTP/1.1\r\n\r\n"+test.request)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil || res.StatusCode != 200 {
+			t.Fatalf("%s: CONNECT failed: %v", test.name, err)
+		}
+		res, err = http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		conn.Close()
+		if string(body) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, body, test.want)
+		}
+	}
+}
+
+func TestSplitMethod(t *testing.T) {
+	upstream := echoRequestLine(t)
+	defer upstream.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = "127.0.0.1:1" // 误判为其他协议时会通过隧道, 连接失败
+	tc.SetRelayMethod("GET")
+	tc.SetRelayUpstream(upstream.Addr().String())
+
+	conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT example.com:80 HTTP/1.1\r\n\r\nGE")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+
+	// 方法分两次到达
+	time.Sleep(100 * time.Millisecond)
+	io.WriteString(conn, "T / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "GET / HTTP/1.1" {
+		t.Errorf("got %q, want relayed GET", body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const size = 200 << 10
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, size))
+	}))
+	defer origin.Close()
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = proxy.Addr().String()
+	tc.SetRateLimit(0, 0, 100<<10)
 
-	msg := []byte("GET / HTTP/1.1\r\nHost: 101.132.157.18\r\n\r\n")
+	start := time.Now()
+	conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
 
-	_, err = conn.Write(msg)
+	r := bufio.NewReader(conn)
+	host := origin.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\nGET / HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil || res.StatusCode != 200 {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	res, err = http.ReadResponse(r, nil)
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes: %v", n, err)
 	}
 
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+	// 第一秒为桶的容量, 之后每秒 100K
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Errorf("unexpected duration %s", d)
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+	origin := fakeUpstream(t, "")
+	defer origin.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = proxy.Addr().String()
+	tc.SetConnLimit(0, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- tc.Serve(l, tunnelclient.SERV_HTTP_PROXY)
+	}()
+
+	connect := func() (net.Conn, int) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		// 超过限制时不读取请求, 立即返回 503
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, err = r.Peek(1); err != nil {
+			conn.SetReadDeadline(time.Time{})
+			fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", origin.Addr())
+		}
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, res.StatusCode
+	}
+
+	first, code := connect()
+	if code != 200 {
+		t.Fatalf("first connection: %d", code)
+	}
+	second, code := connect()
+	second.Close()
+	if code != 503 {
+		t.Errorf("second connection: got %d, want 503", code)
+	}
+
+	first.Close()
+	// 等待第一个连接释放
+	for i := 0; ; i++ {
+		conn, code := connect()
+		conn.Close()
+		if code == 200 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("connection limit not released: %d", code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("Serve returned nil after the listener was closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return after the listener was closed")
+	}
+}
+
+func TestConnLimitSocks5(t *testing.T) {
+	origin := fakeUpstream(t, "")
+	defer origin.Close()
+
+	for _, mode := range []tunnelclient.ServMode{tunnelclient.SERV_SOCKS5, tunnelclient.SERV_MIXED} {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.DestAddr = origin.Addr().String()
+		tc.SetConnLimit(0, 1)
+		addr := serve(t, tc, mode)
+
+		// 占用唯一的连接, 不发送任何数据
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 超过限制时协商后回复 general failure
+		second, rep := socks5Dial(t, addr, origin.Addr().String())
+		second.Close()
+		first.Close()
+		if rep.Rep != gosocks5.Failure {
+			t.Errorf("%s: got reply %d, want general failure", mode, rep.Rep)
+		}
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	if _, err := tunnelclient.ParseIPList([]string{"10.0.0.0/8", "bad"}); err == nil {
+		t.Error("expected error for invalid IP")
+	}
+
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+	for _, tt := range []struct {
+		allow, deny []string
+		ok          bool
+	}{
+		{nil, nil, true},
+		{[]string{"127.0.0.0/8"}, nil, true},
+		{[]string{"10.0.0.0/8"}, nil, false},
+		{[]string{"127.0.0.0/8"}, []string{"127.0.0.1"}, false},
+	} {
+		allow, err := tunnelclient.ParseIPList(tt.allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deny, err := tunnelclient.ParseIPList(tt.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.DestAddr = proxy.Addr().String()
+		tc.SetClientACL(allow, deny)
+
+		conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", proxy.Addr())
+		_, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("allow %v deny %v: got %v, want %v", tt.allow, tt.deny, ok, tt.ok)
+		}
 	}
-	fmt.Println(string(buf[:n]))
+}
 
-	time.Sleep(4e9)
-	_, err = conn.Write(msg)
+func TestDestPolicy(t *testing.T) {
+	ports, err := tunnelclient.ParsePortList([]string{"443", "8000-8100"})
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	p := &tunnelclient.DestPolicy{
+		Ports:   ports,
+		Nets:    tunnelclient.PrivateNets,
+		Domains: []string{"example.com"},
+	}
+	for host, ok := range map[string]bool{
+		"golang.org:443":         true,
+		"golang.org:8080":        true,
+		"golang.org:25":          false,
+		"10.1.2.3:443":           false,
+		"[::1]:443":              false,
+		"[::ffff:127.0.0.1]:443": false,
+		"8.8.8.8:443":            true,
+		"example.com:443":        false,
+		"www.Example.com.:443":   false,
+		"notexample.com:443":     true,
+	} {
+		if err := p.Check(host); (err == nil) != ok {
+			t.Errorf("%s: got %v, want allowed %v", host, err, ok)
+		}
 	}
 
-	n, err = conn.Read(buf)
+	// 拒绝时 HTTP 返回 403, SOCKS5 返回 not allowed
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = "127.0.0.1:1"
+	tc.SetDestPolicy(p)
+	addr := serve(t, tc, tunnelclient.SERV_MIXED)
+
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:443 HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || res.StatusCode != 403 {
+		t.Errorf("http: got %v %v, want 403", res, err)
+	}
+
+	sconn, rep := socks5Dial(t, addr, "example.com:443")
+	sconn.Close()
+	if rep.Rep != gosocks5.NotAllowed {
+		t.Errorf("socks5: got reply %d, want not allowed", rep.Rep)
 	}
-	fmt.Println(string(buf[:n]))
 
-	time.Sleep(8e9)
-	_, err = conn.Write(msg)
+	// 中继的请求按 Host 请求头或 absolute-form 检查, 没有端口时为 80
+	upstream := echoRequestLine(t)
+	defer upstream.Close()
+	tc.SetRelayMethod("GET")
+	tc.SetRelayUpstream(upstream.Addr().String())
+	addr = serve(t, tc, tunnelclient.SERV_HTTP_PROXY)
+	for request, want := range map[string]int{
+		"GET / HTTP/1.1\r\nHost: golang.org:8080\r\n\r\n":                       200,
+		"GET / HTTP/1.1\r\nHost: 10.1.2.3:443\r\n\r\n":                          403,
+		"GET / HTTP/1.1\r\nHost: golang.org\r\n\r\n":                            403,
+		"GET http://example.com:443/ HTTP/1.1\r\nHost: golang.org:8080\r\n\r\n": 403,
+		"GET / HTTP/1.1\r\n\r\n":                                                200,
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT golang.org:443 HTTP/1.1\r\n\r\n"+request)
+		res, err := http.ReadResponse(r, nil)
+		if err == nil {
+			res, err = http.ReadResponse(r, nil)
+		}
+		conn.Close()
+		if err != nil || res.StatusCode != want {
+			t.Errorf("relay %q: got %v %v, want %d", request, res, err, want)
+		}
+	}
+}
+
+// socks5Dial 通过 addr 的 SOCKS5 服务 CONNECT 到 target, 返回连接和回复
+func socks5Dial(t *testing.T, addr, target string) (net.Conn, *gosocks5.Reply) {
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	c := gosocks5.ClientConn(conn, nil)
+	if err = c.Handleshake(); err != nil {
+		t.Fatal(err)
 	}
+	a, err := gosocks5.NewAddr(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gosocks5.NewRequest(gosocks5.CmdConnect, a).Write(c); err != nil {
+		t.Fatal(err)
+	}
+	// 只读取回复本身, 之后的数据留在连接中
+	head := make([]byte, 5)
+	if _, err = io.ReadFull(c, head); err != nil {
+		t.Fatal(err)
+	}
+	rest := map[byte]int{gosocks5.AddrIPv4: 5, gosocks5.AddrIPv6: 17, gosocks5.AddrDomain: int(head[4]) + 2}[head[3]]
+	b := make([]byte, len(head)+rest)
+	copy(b, head)
+	if _, err = io.ReadFull(c, b[len(head):]); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := gosocks5.ReadReply(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, rep
+}
 
-	n, err = conn.Read(buf)
+func TestSocks5Reply(t *testing.T) {
+	origin := fakeUpstream(t, "")
+	defer origin.Close()
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+	refuse := fakeUpstream(t, "")
+	refuse.Close()
+
+	for _, tt := range []struct {
+		name   string
+		hop    tunnelclient.Hop
+		target string
+		rep    uint8
+	}{
+		{"ok", tunnelclient.Hop{Type: tunnelclient.HopHTTP, Addr: proxy.Addr().String()}, origin.Addr().String(), gosocks5.Succeeded},
+		{"forbidden", tunnelclient.Hop{Type: tunnelclient.HopHTTP, Addr: origin.Addr().String()}, "example.com:443", gosocks5.NotAllowed},
+		{"refused", tunnelclient.Hop{Type: tunnelclient.HopHTTP, Addr: refuse.Addr().String()}, "example.com:443", gosocks5.ConnRefused},
+	} {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.SetChain([]tunnelclient.Hop{tt.hop})
+		conn, rep := socks5Dial(t, serve(t, tc, tunnelclient.SERV_SOCKS5), tt.target)
+		conn.Close()
+		if rep.Rep != tt.rep {
+			t.Errorf("%s: got reply %d, want %d", tt.name, rep.Rep, tt.rep)
+		}
+		if rep.Rep == gosocks5.Succeeded && (rep.Addr == nil || rep.Addr.Port == 0) {
+			t.Errorf("%s: unexpected BND.ADDR %v", tt.name, rep.Addr)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	refuse := fakeUpstream(t, "")
+	refuse.Close()
+	deny, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Fatalln(err)
+		t.Fatal(err)
+	}
+	defer deny.Close()
+	go func() {
+		for {
+			conn, err := deny.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				io.WriteString(conn, "HTTP/1.1 403 Forbidden\r\nX-Reason: policy\r\nContent-Length: 6\r\n\r\ndenied")
+			}()
+		}
+	}()
+
+	for _, tt := range []struct {
+		upstream string
+		page     *template.Template
+		code     int
+		body     string
+	}{
+		{refuse.Addr().String(), nil, 502, "502 Bad Gateway: "},
+		{refuse.Addr().String(), template.Must(template.New("").Parse("<b>{{.Code}} {{.Target}}</b>")), 502, "<b>502 example.com:80</b>"},
+		{deny.Addr().String(), nil, 403, "denied"},
+	} {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.DestAddr = tt.upstream
+		tc.SetErrorPage(tt.page)
+		tc.SetStrictConnect(true)
+
+		conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "CONNECT example.com:80 HTTP/1.1\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		conn.Close()
+		if err != nil || res.StatusCode != tt.code || res.ContentLength != int64(len(body)) || !strings.HasPrefix(string(body), tt.body) {
+			t.Errorf("%s: got %d %q (Content-Length %d), want %d %q", tt.upstream, res.StatusCode, body, res.ContentLength, tt.code, tt.body)
+		}
+		if tt.code == 403 && res.Header.Get("X-Reason") != "policy" {
+			t.Errorf("upstream headers not passed through: %v", res.Header)
+		}
+	}
+}
+
+func TestConnectReply(t *testing.T) {
+	refuse := fakeUpstream(t, "")
+	refuse.Close()
+	deny := fakeUpstream(t, "")
+	defer deny.Close()
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+	origin := fakeUpstream(t, "")
+	defer origin.Close()
+
+	for _, tt := range []struct {
+		strict   bool
+		upstream string
+		connect  int  // CONNECT 的状态码
+		reset    bool // lazy 时发送数据后连接被重置
+	}{
+		{false, refuse.Addr().String(), 200, true},
+		{false, deny.Addr().String(), 200, true},
+		{true, refuse.Addr().String(), 502, false},
+		{true, deny.Addr().String(), 403, false},
+		{true, proxy.Addr().String(), 200, false},
+	} {
+		tc := tunnelclient.NewTunnelHTTPClient()
+		tc.DestAddr = tt.upstream
+		tc.SetStrictConnect(tt.strict)
+
+		conn, err := net.Dial("tcp", serve(t, tc, tunnelclient.SERV_HTTP_PROXY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", origin.Addr())
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.connect {
+			t.Errorf("strict %v, %s: CONNECT got %d, want %d", tt.strict, tt.upstream, res.StatusCode, tt.connect)
+		}
+		if tt.reset {
+			// 隧道内不应收到 HTTP 错误响应, 如 TLS 客户端无法解析
+			io.WriteString(conn, "\x16\x03\x01\x00\x05hello")
+			b, err := ioutil.ReadAll(r)
+			if len(b) != 0 || !isReset(err) {
+				t.Errorf("strict %v, %s: got %q %v, want connection reset", tt.strict, tt.upstream, b, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestStallingUpstream(t *testing.T) {
+	defer tunnelclient.SetDialTimeout(200 * time.Millisecond)()
+
+	// 接受连接, 读取请求后不回复
+	stall, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stall.Close()
+	go func() {
+		for {
+			conn, err := stall.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = stall.Addr().String()
+	tc.SetStrictConnect(true)
+	addr := serve(t, tc, tunnelclient.SERV_MIXED)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("http: got %v %v, want 504", res, err)
+	}
+
+	sconn, rep := socks5Dial(t, addr, "example.com:443")
+	sconn.Close()
+	if rep.Rep != gosocks5.TTLExpired {
+		t.Errorf("socks5: got reply %d, want TTL expired", rep.Rep)
+	}
+}
+
+// isReset 连接是否被对方以 RST 关闭
+func isReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+// pipeDialer 不经过网络, 每次连接由 handler 在内存中处理
+type pipeDialer struct {
+	mu      sync.Mutex
+	addrs   []string
+	handler func(conn net.Conn)
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, addr)
+	d.mu.Unlock()
+	client, server := net.Pipe()
+	go d.handler(server)
+	return client, nil
+}
+
+// dialed 返回并清空连接过的地址
+func (d *pipeDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addrs := d.addrs
+	d.addrs = nil
+	return addrs
+}
+
+func TestDialer(t *testing.T) {
+	// CONNECT 时原样返回隧道内的数据, 其他请求为中继
+	d := &pipeDialer{
+		handler: func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			if req.Method != http.MethodConnect {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nrelay")
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			io.Copy(conn, r)
+		},
+	}
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = "upstream.invalid:8080"
+	tc.SetDialer(d)
+
+	res, err := tc.Probe("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.StatusLine, "200") {
+		t.Errorf("unexpected status: %s", res.StatusLine)
+	}
+	if addrs := d.dialed(); len(addrs) != 1 || addrs[0] != tc.DestAddr {
+		t.Errorf("probe: dialed %v, want %s", addrs, tc.DestAddr)
+	}
+
+	tc.SetRelayMethod("GET")
+	tc.SetRelayUpstream("relay.invalid:3128")
+	addr := serve(t, tc, tunnelclient.SERV_HTTP_PROXY)
+	for _, test := range []struct {
+		name, data, want, dialed string
+	}{
+		{"tunnel", "ping", "ping", tc.DestAddr},
+		{"relay", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "relay", "relay.invalid:3128"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\n\r\n"+test.data)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil || res.StatusCode != 200 {
+			t.Fatalf("%s: CONNECT failed: %v", test.name, err)
+		}
+		got := make([]byte, len(test.want))
+		if test.name == "relay" {
+			res, err = http.ReadResponse(r, nil)
+			if err == nil {
+				got, err = ioutil.ReadAll(res.Body)
+			}
+		} else {
+			_, err = io.ReadFull(r, got)
+		}
+		conn.Close()
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q %v, want %q", test.name, got, err, test.want)
+		}
+		if addrs := d.dialed(); len(addrs) != 1 || addrs[0] != test.dialed {
+			t.Errorf("%s: dialed %v, want %s", test.name, addrs, test.dialed)
+		}
+	}
+}
+
+func TestBindDialer(t *testing.T) {
+	if _, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Addr: "nope"}); err == nil {
+		t.Error("expected error for invalid address")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d, err := tunnelclient.NewBindDialer(tunnelclient.BindOptions{Addr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("bound to %s", ip)
+	}
+
+	// Interface 和 Mark 只支持 linux, 见 dialer_linux_test.go
+	if runtime.GOOS != "linux" {
+		for _, opt := range []tunnelclient.BindOptions{{Interface: "lo"}, {Mark: 0x100}} {
+			if _, err := tunnelclient.NewBindDialer(opt); err != tunnelclient.ErrBindUnsupported {
+				t.Errorf("%+v: got %v, want ErrBindUnsupported", opt, err)
+			}
+		}
+	}
+}
+
+func TestServerSpeaksFirst(t *testing.T) {
+	// 模拟 SMTP 等先发送 banner 的服务
+	banner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer banner.Close()
+	go func() {
+		for {
+			conn, err := banner.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "220 ready\r\n")
+			conn.Close()
+		}
+	}()
+	proxy := forwardProxy(t, tunnelclient.HopHTTP)
+	defer proxy.Close()
+
+	tc := tunnelclient.NewTunnelHTTPClient()
+	tc.DestAddr = proxy.Addr().String()
+	tc.SetStrictConnect(true)
+	addr := serve(t, tc, tunnelclient.SERV_MIXED)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	r := bufio.NewReader(conn)
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\n\r\n", banner.Addr())
+	if res, err := http.ReadResponse(r, nil); err != nil || res.StatusCode != 200 {
+		t.Fatalf("CONNECT failed: %v", err)
+	}
+	if line, err := r.ReadString('\n'); line != "220 ready\r\n" {
+		t.Errorf("http: got %q %v", line, err)
+	}
+
+	sconn, rep := socks5Dial(t, addr, banner.Addr().String())
+	defer sconn.Close()
+	if rep.Rep != gosocks5.Succeeded {
+		t.Fatalf("socks5: reply %d", rep.Rep)
+	}
+	sconn.SetDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(sconn).ReadString('\n'); line != "220 ready\r\n" {
+		t.Errorf("socks5: got %q %v", line, err)
 	}
-	fmt.Println(string(buf[:n]))
 }
@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"github.com/ginuerzh/gosocks5"
+	"html/template"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
@@ -17,10 +20,37 @@ type (
 	HeadersFunc func(host []byte) string
 
 	TunnelHTTPClient struct {
+		tunnelConfig
+		mu      sync.RWMutex
+		metrics *Metrics
+		limits  *limits
+		global  *bandwidth // 加入 Server 后为 Server 的全局限速
+
+		user string // 单个连接认证通过的用户
+	}
+
+	// tunnelConfig 可在运行时替换的配置, 每个连接持有一份副本
+	tunnelConfig struct {
+		Name        string
+		Mode        ServMode // 由 Server 启动时使用的模式
 		DestAddr    string
-		LocalAddr   string
+		LocalAddr   string // host:port, unix:/path/to.sock 或 systemd:name
+		SocketMode  os.FileMode
+		SocketOwner string // unix socket 的所有者, user:group
 		headersFunc HeadersFunc
+		chain       []Hop
 		relayMethod []string
+		// relayAddr 和 relayHeadersFunc 为 RelayMethod 请求单独的上游
+		relayAddr        string
+		relayHeadersFunc HeadersFunc
+		relayAbsoluteURI bool
+		users            map[string]string
+		allowClients     IPList
+		denyClients      IPList
+		destPolicy       *DestPolicy
+		errorPage        *template.Template
+		strictConnect    bool
+		dialer           Dialer
 	}
 )
 
@@ -28,6 +58,17 @@ const (
 	SERV_HTTP_PROXY ServMode = iota
 	SERV_SOCKS5
 	SERV_REDIRECT
+	// SERV_MIXED 根据首个字节区分 SOCKS5 和 HTTP
+	SERV_MIXED
+)
+
+var (
+	servModeNames = map[ServMode]string{
+		SERV_HTTP_PROXY: "http",
+		SERV_SOCKS5:     "socks5",
+		SERV_REDIRECT:   "redirect",
+		SERV_MIXED:      "mixed",
+	}
 )
 
 var (
@@ -39,36 +80,145 @@ var (
 	}
 )
 
+// ParseServMode 解析 http, socks5, redirect 或 mixed
+func ParseServMode(s string) (ServMode, error) {
+	for mode, name := range servModeNames {
+		if name == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown serve mode: %s", s)
+}
+
+func (st ServMode) String() string {
+	if name, ok := servModeNames[st]; ok {
+		return name
+	}
+	return fmt.Sprintf("ServMode(%d)", int(st))
+}
+
 func NewTunnelHTTPClient() *TunnelHTTPClient {
-	return &TunnelHTTPClient{}
+	return &TunnelHTTPClient{
+		metrics: &Metrics{},
+		limits:  &limits{},
+	}
+}
+
+// Metrics 返回统计, 加入 Server 后为 Server 共享的统计
+func (thc *TunnelHTTPClient) Metrics() *Metrics {
+	return thc.metrics
 }
 
 func (thc *TunnelHTTPClient) SetHeadersFunc(fn HeadersFunc) {
 	thc.headersFunc = fn
 }
 
+// SetStrictConnect strict 为 true 时, 上游建立隧道后才回复 200 Connection established,
+// 失败时返回上游的错误. 为 false 时立即回复, 客户端发送数据后再连接上游,
+// 只有 RelayMethod 请求时不需要连接隧道, 上游失败时重置连接.
+func (thc *TunnelHTTPClient) SetStrictConnect(strict bool) {
+	thc.strictConnect = strict
+}
+
+// Update 在服务运行时修改配置, 只对之后接受的连接生效, 已建立的隧道不受影响
+func (thc *TunnelHTTPClient) Update(fn func(c *TunnelHTTPClient)) {
+	thc.mu.Lock()
+	defer thc.mu.Unlock()
+	fn(thc)
+}
+
+// clone 复制当前配置, 供单个连接使用
+func (thc *TunnelHTTPClient) clone() *TunnelHTTPClient {
+	thc.mu.RLock()
+	defer thc.mu.RUnlock()
+	return &TunnelHTTPClient{
+		tunnelConfig: thc.tunnelConfig,
+		metrics:      thc.metrics,
+		limits:       thc.limits,
+		global:       thc.global,
+	}
+}
+
 // ListenAndServe 启动服务1
 func (thc *TunnelHTTPClient) ListenAndServe(st ServMode) (err error) {
-	listener, err := net.Listen("tcp", thc.LocalAddr)
+	listener, err := thc.Listen()
 	if err != nil {
 		return
 	}
+	return thc.Serve(listener, st)
+}
 
+// Serve 在已有的监听上启动服务, 临时错误时等待后重试, 其他错误时返回
+func (thc *TunnelHTTPClient) Serve(listener net.Listener, st ServMode) error {
+	var delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("accept error: %s\n", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = acceptDelay(delay)
+				log.Printf("accept error: %s, retrying in %s\n", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		c := thc.clone()
+		if !c.allowClient(conn) {
+			log.Printf("%s: client %s not allowed\n", c.Name, conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-		switch st {
-		case SERV_HTTP_PROXY:
-			go thc.handleTunneling(conn)
-		case SERV_SOCKS5:
-			go thc.handleSocks5(conn)
-		case SERV_REDIRECT:
-			go thc.handleRedirect(conn)
+		// 在启动 goroutine 之前检查连接数, 超过时只回复错误后关闭
+		ip := remoteIP(conn)
+		if !c.limits.conns.acquire(ip) {
+			go c.reject(conn, st)
+			continue
 		}
+		go func() {
+			defer c.limits.conns.release(ip)
+			c.serveConn(conn, st)
+		}()
+	}
+}
+
+func (thc *TunnelHTTPClient) serveConn(conn net.Conn, st ServMode) {
+	thc.metrics.connOpened()
+	defer thc.metrics.connClosed()
+
+	switch st {
+	case SERV_HTTP_PROXY:
+		thc.handleTunneling(conn)
+	case SERV_SOCKS5:
+		thc.handleSocks5(conn)
+	case SERV_REDIRECT:
+		thc.handleRedirect(conn)
+	case SERV_MIXED:
+		thc.handleMixed(conn)
+	default:
+		conn.Close()
+	}
+}
+
+// handleMixed SOCKS5 的首个字节为版本号 5, 其他视为 HTTP
+func (thc *TunnelHTTPClient) handleMixed(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn = &bufferedConn{
+		Conn: conn,
+		r:    r,
+	}
+	if first[0] == gosocks5.Ver5 {
+		thc.handleSocks5(conn)
+		return
 	}
+	thc.handleTunneling(conn)
 }
 
 func (thc *TunnelHTTPClient) handleTunneling(conn net.Conn) {
@@ -93,8 +243,7 @@ func (thc *TunnelHTTPClient) handleTunneling(conn net.Conn) {
 		return
 	}
 
-	fmt.Fprintf(conn, "%s 200 Connection established\r\nConnection: keep-alive\r\n\r\n", fields[2])
-
+	var auth []byte
 	for { // 读取剩下的数据
 		line, _, err := connReader.ReadLine()
 		if err != nil {
@@ -104,141 +253,124 @@ func (thc *TunnelHTTPClient) handleTunneling(conn net.Conn) {
 		if len(line) == 0 { // 读取完毕
 			break
 		}
+		if auth == nil {
+			auth = parseProxyAuthorization(line)
+		}
 	}
 
-	thc.handle(conn, fields[1])
-}
+	user, ok := thc.checkBasicAuth(auth)
+	if !ok {
+		log.Printf("%s: proxy authentication failed from %s\n", thc.Name, conn.RemoteAddr())
+		writeAuthRequired(conn, fields[2])
+		return
+	}
 
-func (thc *TunnelHTTPClient) handle(conn net.Conn, host []byte) {
-	var (
-		// Not Relay Method Conn
-		destConn1 net.Conn
-		// Relay Method Conn
-		destConn2 net.Conn
-		buf       = bufPool.Get().([]byte)
-	)
-	defer bufPool.Put(buf)
+	thc.user = user
 
-	// 关闭所有连接
-	closeAllConn := func() {
-		if destConn1 != nil {
-			destConn1.Close()
-		}
-		if destConn2 != nil {
-			destConn2.Close()
-		}
-		conn.Close()
+	if thc.checkDest(conn, fields[1]) != nil {
+		fmt.Fprintf(conn, "%s 403 Forbidden\r\nContent-Length: 0\r\n\r\n", fields[2])
+		return
 	}
-	defer closeAllConn()
 
-	for {
-		n, err := conn.Read(buf) // 读取本地主机的消息
+	// strict 时上游建立隧道后再回复, lazy 时立即回复, 在客户端发送数据后再连接上游
+	var tunnel net.Conn
+	if thc.strictConnect {
+		tunnel, err = thc.dialTunnel(fields[1])
 		if err != nil {
-			// 结束会话
+			thc.tunnelFailed(fields[1], err)
+			io.WriteString(conn, thc.errorResponse(fields[1], thc.chainString(), err))
 			return
 		}
+	}
 
-		// 判断是否为Relay Method
-		// 是的话就直连
-		isRelay, remainLength, newData := thc.checkRelay(buf[:n])
-		if isRelay {
-			if destConn2 == nil {
-				// 初次直连
-				destConn2, err = net.DialTimeout("tcp", thc.DestAddr, 10*time.Second)
-				if err != nil {
-					log.Printf("RELAY: dial2 %s error: %s\n", thc.DestAddr, err)
-					break
-				}
-				go func() {
-					recvBuf := bufPool.Get().([]byte)
-					io.CopyBuffer(conn, destConn2, recvBuf) // 将远端主机的消息发送给本地主机
-					bufPool.Put(recvBuf)
-					// 结束所有, 以退出连接
-					closeAllConn()
-				}()
-			}
-
-			_, err = destConn2.Write(newData)
-			if err != nil {
-				return
-			}
-
-			for remainLength > 0 {
-				n, err = conn.Read(buf)
-				if err != nil {
-					log.Printf("RELAY: read from local %s error: %s\n", conn.LocalAddr(), err)
-					return
-				}
-
-				remainLength -= int64(n)
-				_, err = destConn2.Write(buf[:n])
-				if err != nil {
-					log.Printf("RELAY: write to remote %s error: %s\n", conn.RemoteAddr(), err)
-					return
-				}
-			}
-			continue
-		}
-
-		// 不是Relay Method
-		if destConn1 == nil {
-			// 初次连接
-			destConn1, err = net.DialTimeout("tcp", thc.DestAddr, 10*time.Second)
-			if err != nil {
-				log.Printf("dial1 %s error: %s\n", thc.DestAddr, err)
-				return
-			}
-
-			destConn1Reader := bufio.NewReader(destConn1)
-
-			// 获取自定义headers
-			var headers string
-			if thc.headersFunc != nil {
-				headers = thc.headersFunc(host)
-			}
-
-			fmt.Fprintf(destConn1, "CONNECT %s HTTP/1.0\r\n%s\r\n", host, headers)
-			destFirstLine, _, err := destConn1Reader.ReadLine()
-			if err != nil {
-				log.Printf("CONNECT %s in %s error: %s\n", host, destConn1.RemoteAddr(), err)
-				return
-			}
+	fmt.Fprintf(conn, "%s 200 Connection established\r\nConnection: keep-alive\r\n\r\n", fields[2])
 
-			destFields := bytes.Fields(destFirstLine)
-			if len(destFields) < 3 {
-				log.Printf("unknown first line from %s: %s\n", destConn1.RemoteAddr(), destFields)
-				return
-			}
+	// 客户端可能在收到响应前就发送了数据, 已读入 connReader
+	thc.handle(&bufferedConn{
+		Conn: conn,
+		r:    connReader,
+	}, fields[1], tunnel)
+}
 
-			if destFields[1][0] != '2' {
-				//error
-				// 将错误原封返回
-				fmt.Fprintf(conn, "%s\r\n\r\n", destFirstLine)
-				return
-			}
+// handle 转发隧道内的数据, tunnel 为已经建立的隧道, 为 nil 时在需要时建立.
+// 设置了 RelayMethod 且数据为 HTTP 请求时, 按请求分别发往隧道或中继, 否则原样通过隧道.
+func (thc *TunnelHTTPClient) handle(conn net.Conn, host []byte, tunnel net.Conn) {
+	conn = thc.limit(thc.metrics.wrap(conn))
+	defer conn.Close()
 
-			for { // 读取destConn剩下的数据
-				line, _, err := destConn1Reader.ReadLine()
-				if err != nil {
-					log.Printf("read from %s error: %s\n", destConn1.RemoteAddr(), err)
-					return
-				}
-				if len(line) == 0 { // 读取完毕
-					break
-				}
-			}
+	// 隧道已经建立且不需要区分请求时直接转发, SMTP, SSH 等由服务端先发送数据
+	if tunnel != nil && !thc.canRelay() {
+		thc.handleRaw(conn, host, tunnel)
+		return
+	}
 
-			go func() {
-				recvBuf := bufPool.Get().([]byte)
-				io.CopyBuffer(conn, destConn1, recvBuf) // 将远端主机的消息发送给本地主机
-				// 结束所有, 以退出连接
-				closeAllConn()
-			}()
+	r := bufio.NewReader(conn)
+	_, err := r.Peek(1) // 等待客户端发送数据
+	if err != nil {
+		if tunnel != nil {
+			tunnel.Close()
 		}
+		return
+	}
+	if thc.canRelay() && looksLikeHTTP(conn, r) {
+		thc.handleHTTP(conn, r, host, tunnel)
+		return
+	}
+	thc.handleRaw(&bufferedConn{
+		Conn: conn,
+		r:    r,
+	}, host, tunnel)
+}
 
-		_, err = destConn1.Write(buf[:n]) // 将本地主机的消息发送给远端主机
-		if err != nil {
+// tunnelFailed 记录建立隧道的错误
+func (thc *TunnelHTTPClient) tunnelFailed(host []byte, err error) {
+	thc.metrics.upstreamFailed()
+	log.Printf("CONNECT %s through %s error: %s\n", host, thc.chainString(), err)
+}
+
+// resetOnClose 关闭时发送 RST, 让已经收到 200 的客户端知道隧道没有建立,
+// 而不是在隧道内收到无法解析的错误响应
+func resetOnClose(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *bufferedConn:
+			conn = c.Conn
+		case *limitConn:
+			conn = c.Conn
+		case *countConn:
+			conn = c.Conn
+		case *net.TCPConn:
+			c.SetLinger(0)
+			return
+		default:
 			return
 		}
 	}
 }
+
+// handleRaw 原样通过隧道转发
+func (thc *TunnelHTTPClient) handleRaw(conn net.Conn, host []byte, destConn net.Conn) {
+	var err error
+	if destConn == nil {
+		destConn, err = thc.dialTunnel(host)
+	}
+	if err != nil {
+		thc.tunnelFailed(host, err)
+		resetOnClose(conn)
+		return
+	}
+	defer destConn.Close()
+
+	go func() {
+		recvBuf := bufPool.Get().([]byte)
+		io.CopyBuffer(conn, destConn, recvBuf) // 将远端主机的消息发送给本地主机
+		bufPool.Put(recvBuf)
+		// 结束所有, 以退出连接
+		conn.Close()
+		destConn.Close()
+	}()
+
+	buf := bufPool.Get().([]byte)
+	io.CopyBuffer(destConn, conn, buf) // 将本地主机的消息发送给远端主机
+	bufPool.Put(buf)
+}
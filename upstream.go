@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/iikira/tcp_over_http_proxy/lineconfig"
+	"github.com/iikira/tcp_over_http_proxy/tunnelclient"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+var (
+	ErrNoCert = errors.New("no PEM certificate found")
+)
+
+func checkHopType(value string) error {
+	_, err := tunnelclient.ParseHopType(strings.TrimSpace(value))
+	return err
+}
+
+func checkCertPool(value string) error {
+	_, err := loadCertPool(value)
+	return err
+}
+
+// loadCertPool 读取 PEM 格式的 CA 证书
+func loadCertPool(fPath string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(strings.TrimSpace(fPath))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrNoCert
+	}
+	return pool, nil
+}
+
+// upstreamHops 返回上游的代理链, 有 Chain 时依次使用其中的上游, 否则只有上游本身
+func upstreamHops(c, up *lineconfig.LineConfig) []tunnelclient.Hop {
+	chain := up.List("Chain", nil)
+	if len(chain) == 0 {
+		return []tunnelclient.Hop{newHop(up)}
+	}
+	hops := make([]tunnelclient.Hop, len(chain))
+	for k, name := range chain {
+		hops[k] = newHop(upstreamConfig(c, name))
+	}
+	return hops
+}
+
+// newHop 按 [upstream.name] 的 Type, DestAddr, Headers, Auth 和 TLS 设置创建一个代理
+func newHop(up *lineconfig.LineConfig) tunnelclient.Hop {
+	hop := tunnelclient.Hop{
+		Addr: up.HostPort("DestAddr", ""),
+	}
+	hop.Type, _ = tunnelclient.ParseHopType(up.String("Type", "http"))
+
+	headers := up.String("Headers", "")
+	hop.Headers = func(host []byte) string {
+		return headers
+	}
+
+	if auth := strings.SplitN(up.String("Auth", ""), ":", 2); len(auth) == 2 {
+		hop.Username, hop.Password = auth[0], auth[1]
+	}
+
+	if hop.Type == tunnelclient.HopHTTPS {
+		hop.TLS = &tls.Config{
+			ServerName:         up.String("TLSServerName", ""),
+			InsecureSkipVerify: up.Bool("TLSInsecure", false),
+		}
+		if ca, ok := up.Get("TLSCA"); ok {
+			pool, err := loadCertPool(ca)
+			if err != nil {
+				log.Printf("upstream %s: load TLSCA error: %s\n", up.Name(), err)
+			}
+			hop.TLS.RootCAs = pool
+		}
+	}
+	return hop
+}
+
+// validateUpstreams 上游需要 DestAddr 或 Chain, Chain 中的上游必须存在, 且不能再有 Chain
+func validateUpstreams(c *lineconfig.LineConfig) lineconfig.ErrorList {
+	var errs lineconfig.ErrorList
+	for _, name := range upstreamNames(c) {
+		up := upstreamConfig(c, name)
+		key := "Chain"
+		if name != "" {
+			key = upstreamSection + "." + name
+		}
+		if !hasUpstream(up) {
+			errs = append(errs, &lineconfig.ParseError{
+				Key:    key,
+				Reason: "missing DestAddr or Chain",
+			})
+			continue
+		}
+		for _, hopName := range up.List("Chain", nil) {
+			hop := upstreamConfig(c, hopName)
+			reason := ""
+			switch {
+			case hop == nil:
+				reason = "unknown upstream " + hopName + " in Chain"
+			case len(hop.List("Chain", nil)) > 0:
+				reason = "upstream " + hopName + " in Chain has its own Chain"
+			default:
+				if _, ok := hop.Get("DestAddr"); !ok {
+					reason = "upstream " + hopName + " in Chain has no DestAddr"
+				}
+			}
+			if reason == "" {
+				continue
+			}
+			errs = append(errs, &lineconfig.ParseError{
+				Key:    key,
+				Reason: reason,
+			})
+		}
+	}
+	return errs
+}
+
+// checkRelayUpstream RelayUpstream 为 direct 或者一个 HTTP 代理, 不能是代理链
+func checkRelayUpstream(c *lineconfig.LineConfig, name string) string {
+	if name == "" || name == tunnelclient.RelayDirect {
+		return ""
+	}
+	up := upstreamConfig(c, name)
+	switch {
+	case up == nil:
+		return "unknown RelayUpstream " + name
+	case len(up.List("Chain", nil)) > 0:
+		return "RelayUpstream " + name + " should not be a chain"
+	case strings.TrimSpace(up.String("Type", "http")) != tunnelclient.HopHTTP.String():
+		return "RelayUpstream " + name + " should be an http proxy"
+	}
+	return ""
+}